@@ -6,6 +6,7 @@ package api
 import (
 	"time"
 
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 )
 
@@ -14,6 +15,14 @@ type RemoteEndpoints interface {
 }
 
 type RemoteEngine interface {
+	// MinT returns the timestamp of the oldest sample which the engine can query, in milliseconds.
+	MinT() int64
+	// MaxT returns the timestamp of the newest sample which the engine can query, in milliseconds.
+	MaxT() int64
+	// LabelSets returns the external labels of the engine, which are set on all of its series.
+	// An engine without external labels can have series with any labels.
+	LabelSets() []labels.Labels
+
 	NewInstantQuery(opts *promql.QueryOpts, qs string, ts time.Time) (promql.Query, error)
 	NewRangeQuery(opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error)
 }
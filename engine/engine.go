@@ -12,6 +12,7 @@ import (
 	"math"
 	"runtime"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/thanos-community/promql-engine/api"
@@ -21,15 +22,18 @@ import (
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/util/stats"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/thanos-community/promql-engine/execution"
 	"github.com/thanos-community/promql-engine/execution/model"
 	"github.com/thanos-community/promql-engine/execution/parse"
 	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 type QueryType int
@@ -39,6 +43,17 @@ const (
 	RangeQuery   QueryType = 2
 )
 
+func (t QueryType) String() string {
+	switch t {
+	case InstantQuery:
+		return "instant"
+	case RangeQuery:
+		return "range"
+	default:
+		return "unknown"
+	}
+}
+
 type Opts struct {
 	promql.EngineOpts
 
@@ -53,6 +68,54 @@ type Opts struct {
 	// If nil, nothing will be printed.
 	// NOTE: Users will not check the errors, debug writing is best effort.
 	DebugWriter io.Writer
+
+	// EnableAnalysis enables recording execution statistics for each operator,
+	// which are returned by ExplainableQuery.Analyze.
+	EnableAnalysis bool
+
+	// EnableTracing enables creating a span for each operator of a query, with child spans
+	// for loading series. Spans are created with the tracer provider of the span in the
+	// context of the query, and are not recorded if the context has no span.
+	EnableTracing bool
+
+	// MemoryLimitBytes is the maximum number of bytes which a query can hold at once for
+	// buffering series and samples. Queries exceeding it are cancelled with an error
+	// wrapping query.ErrMemoryLimitExceeded. Zero or a negative value disables the limit.
+	MemoryLimitBytes int64
+
+	// MaxQueryParallelism is the maximum number of shards and workers which an operator of a
+	// query uses to process data concurrently. It defaults to half of GOMAXPROCS.
+	MaxQueryParallelism int
+
+	// WorkerBudget is the number of workers which are shared by all queries of the engine.
+	// Before a query is executed, it reserves workers for its parallelism from the budget
+	// and waits while the budget is exhausted. Zero or a negative value disables the budget.
+	WorkerBudget int
+
+	// ReplicaLabels are the external labels which identify replicas of the same data in the
+	// distributed engine. Results of remote engines whose label sets only differ in replica
+	// labels are deduplicated, and the replica labels are removed from their series.
+	ReplicaLabels []string
+
+	// EnablePartialResponse makes queries of the distributed engine return the data of the
+	// remote engines which succeeded when others fail. Failures of remote engines are
+	// returned as warnings of the query result instead of failing the query.
+	EnablePartialResponse bool
+}
+
+func (o Opts) getMaxQueryParallelism() int {
+	parallelism := o.MaxQueryParallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0) / 2
+	}
+	// A query can not use more workers than the engine has.
+	if o.WorkerBudget > 0 && parallelism > o.WorkerBudget {
+		parallelism = o.WorkerBudget
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	return parallelism
 }
 
 func (o Opts) getLogicalOptimizers() []logicalplan.Optimizer {
@@ -75,6 +138,15 @@ func NewLocalEngine(opts Opts, q storage.Queryable) *localEngine {
 	}
 }
 
+// MinT returns the smallest timestamp since the local engine can query any time range of its storage.
+func (l localEngine) MinT() int64 { return math.MinInt64 }
+
+// MaxT returns the largest timestamp since the local engine can query any time range of its storage.
+func (l localEngine) MaxT() int64 { return math.MaxInt64 }
+
+// LabelSets returns no label sets since the local engine has no external labels.
+func (l localEngine) LabelSets() []labels.Labels { return nil }
+
 func (l localEngine) NewInstantQuery(opts *promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
 	return l.engine.NewInstantQuery(l.q, opts, qs, ts)
 }
@@ -91,7 +163,7 @@ type distributedEngine struct {
 func NewDistributedEngine(opts Opts, endpoints api.RemoteEndpoints) v1.QueryEngine {
 	opts.LogicalOptimizers = append(
 		opts.LogicalOptimizers,
-		logicalplan.DistributedExecutionOptimizer{Endpoints: endpoints},
+		logicalplan.DistributedExecutionOptimizer{Endpoints: endpoints, ReplicaLabels: opts.ReplicaLabels},
 	)
 	return &distributedEngine{
 		endpoints:   endpoints,
@@ -99,7 +171,9 @@ func NewDistributedEngine(opts Opts, endpoints api.RemoteEndpoints) v1.QueryEngi
 	}
 }
 
-func (l distributedEngine) SetQueryLogger(log promql.QueryLogger) {}
+func (l distributedEngine) SetQueryLogger(log promql.QueryLogger) {
+	l.localEngine.SetQueryLogger(log)
+}
 
 func (l distributedEngine) NewInstantQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
 	return l.localEngine.NewInstantQuery(q, opts, qs, ts)
@@ -109,6 +183,10 @@ func (l distributedEngine) NewRangeQuery(q storage.Queryable, opts *promql.Query
 	return l.localEngine.NewRangeQuery(q, opts, qs, start, end, interval)
 }
 
+func (l distributedEngine) ExplainLogicalPlan(qs string, start, end time.Time) ([]logicalplan.OptimizerPass, error) {
+	return l.localEngine.ExplainLogicalPlan(qs, start, end)
+}
+
 func New(opts Opts) *compatibilityEngine {
 	if opts.Logger == nil {
 		opts.Logger = log.NewNopLogger()
@@ -117,6 +195,17 @@ func New(opts Opts) *compatibilityEngine {
 		opts.LookbackDelta = 5 * time.Minute
 		level.Debug(opts.Logger).Log("msg", "lookback delta is zero, setting to default value", "value", 5*time.Minute)
 	}
+	if opts.NoStepSubqueryIntervalFn == nil {
+		opts.NoStepSubqueryIntervalFn = func(int64) int64 {
+			return time.Minute.Milliseconds()
+		}
+		level.Debug(opts.Logger).Log("msg", "no step subquery interval function is nil, setting to default value", "value", time.Minute)
+	}
+
+	var workerBudget *semaphore.Weighted
+	if opts.WorkerBudget > 0 {
+		workerBudget = semaphore.NewWeighted(int64(opts.WorkerBudget))
+	}
 
 	return &compatibilityEngine{
 		prom: promql.NewEngine(opts.EngineOpts),
@@ -126,28 +215,93 @@ func New(opts Opts) *compatibilityEngine {
 				Help: "Number of PromQL queries.",
 			}, []string{"fallback"},
 		),
-		debugWriter:       opts.DebugWriter,
-		disableFallback:   opts.DisableFallback,
-		logger:            opts.Logger,
-		lookbackDelta:     opts.LookbackDelta,
-		logicalOptimizers: opts.getLogicalOptimizers(),
+		fallbacks: promauto.With(opts.Reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "promql_engine_fallbacks_total",
+				Help: "Number of PromQL queries which fell back to the Prometheus engine, by the unsupported function or expression.",
+			}, []string{"reason"},
+		),
+		queryDuration: promauto.With(opts.Reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "promql_engine_query_duration_seconds",
+				Help:    "Duration of PromQL queries executed by the engine.",
+				Buckets: prometheus.DefBuckets,
+			}, []string{"query_type"},
+		),
+		samples: promauto.With(opts.Reg).NewCounter(
+			prometheus.CounterOpts{
+				Name: "promql_engine_samples_total",
+				Help: "Number of samples selected by PromQL queries executed by the engine.",
+			},
+		),
+		series: promauto.With(opts.Reg).NewCounter(
+			prometheus.CounterOpts{
+				Name: "promql_engine_series_total",
+				Help: "Number of series loaded by PromQL queries executed by the engine.",
+			},
+		),
+		debugWriter:           opts.DebugWriter,
+		disableFallback:       opts.DisableFallback,
+		enablePerStepStats:    opts.EnablePerStepStats,
+		enableAnalysis:        opts.EnableAnalysis,
+		enableTracing:         opts.EnableTracing,
+		enablePartialResponse: opts.EnablePartialResponse,
+		logger:                opts.Logger,
+		lookbackDelta:         opts.LookbackDelta,
+		maxSamples:            opts.MaxSamples,
+		memoryLimitBytes:      opts.MemoryLimitBytes,
+		parallelism:           opts.getMaxQueryParallelism(),
+		timeout:               opts.Timeout,
+		activeQueryTracker:    opts.ActiveQueryTracker,
+		workerBudget:          workerBudget,
+		logicalOptimizers:     opts.getLogicalOptimizers(),
+		noStepSubqueryIntervalFn: func(d time.Duration) time.Duration {
+			return time.Duration(opts.NoStepSubqueryIntervalFn(d.Milliseconds())) * time.Millisecond
+		},
 	}
 }
 
 type compatibilityEngine struct {
-	prom    *promql.Engine
-	queries *prometheus.CounterVec
+	prom          *promql.Engine
+	queries       *prometheus.CounterVec
+	fallbacks     *prometheus.CounterVec
+	queryDuration *prometheus.HistogramVec
+	samples       prometheus.Counter
+	series        prometheus.Counter
 
 	debugWriter io.Writer
 
-	disableFallback   bool
-	logger            log.Logger
-	lookbackDelta     time.Duration
-	logicalOptimizers []logicalplan.Optimizer
+	disableFallback       bool
+	enablePerStepStats    bool
+	enableAnalysis        bool
+	enableTracing         bool
+	enablePartialResponse bool
+	logger                log.Logger
+	lookbackDelta         time.Duration
+	maxSamples            int
+	memoryLimitBytes      int64
+	parallelism           int
+	workerBudget          *semaphore.Weighted
+	timeout               time.Duration
+	activeQueryTracker    promql.QueryTracker
+	logicalOptimizers     []logicalplan.Optimizer
+
+	queryLogger     promql.QueryLogger
+	queryLoggerLock sync.RWMutex
+
+	noStepSubqueryIntervalFn func(time.Duration) time.Duration
 }
 
-func (e *compatibilityEngine) SetQueryLogger(l promql.QueryLogger) {
-	e.prom.SetQueryLogger(l)
+// ExplainLogicalPlan returns the logical plan of the query before optimization
+// and after each of the logical optimizers of the engine.
+func (e *compatibilityEngine) ExplainLogicalPlan(qs string, start, end time.Time) ([]logicalplan.OptimizerPass, error) {
+	expr, err := parser.ParseExpr(qs)
+	if err != nil {
+		return nil, err
+	}
+
+	_, passes := logicalplan.New(expr, e.queryOptions(start, end, 0, nil, nil)).Explain(e.logicalOptimizers)
+	return passes, nil
 }
 
 func (e *compatibilityEngine) NewInstantQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
@@ -156,12 +310,21 @@ func (e *compatibilityEngine) NewInstantQuery(q storage.Queryable, opts *promql.
 		return nil, err
 	}
 
-	lplan := logicalplan.New(expr, ts, ts)
+	timers := stats.NewQueryTimers()
+	planTimer := timers.GetTimer(stats.QueryPreparationTime).Start()
+
+	sampleTracker := query.NewSampleTracker(ts, ts, 0)
+	memoryTracker := query.NewMemoryTracker(e.memoryLimitBytes)
+	queryOpts := e.queryOptions(ts, ts, 0, sampleTracker, memoryTracker)
+
+	lplan := logicalplan.New(expr, queryOpts)
 	lplan = lplan.Optimize(e.logicalOptimizers)
 
-	exec, err := execution.New(lplan.Expr(), q, ts, ts, 0, e.lookbackDelta)
+	exec, err := execution.New(lplan.Expr(), q, queryOpts)
+	planTimer.Stop()
 	if e.triggerFallback(err) {
 		e.queries.WithLabelValues("true").Inc()
+		e.fallbacks.WithLabelValues(parse.Reason(err)).Inc()
 		return e.prom.NewInstantQuery(q, opts, qs, ts)
 	}
 	e.queries.WithLabelValues("false").Inc()
@@ -174,11 +337,20 @@ func (e *compatibilityEngine) NewInstantQuery(q storage.Queryable, opts *promql.
 	}
 
 	return &compatibilityQuery{
-		Query:  &Query{exec: exec},
-		engine: e,
-		expr:   expr,
-		ts:     ts,
-		t:      InstantQuery,
+		Query:              &Query{exec: exec, enableAnalysis: e.enableAnalysis},
+		engine:             e,
+		expr:               expr,
+		ts:                 ts,
+		start:              ts,
+		end:                ts,
+		t:                  InstantQuery,
+		resultSort:         newResultSort(expr),
+		timers:             timers,
+		sampleTracker:      sampleTracker,
+		sampleLimiter:      queryOpts.SampleLimiter,
+		memoryTracker:      memoryTracker,
+		warnings:           queryOpts.Warnings,
+		enablePerStepStats: e.enablePerStepStats && opts != nil && opts.EnablePerStepStats,
 	}, nil
 }
 
@@ -193,12 +365,21 @@ func (e *compatibilityEngine) NewRangeQuery(q storage.Queryable, opts *promql.Qu
 		return nil, errors.Newf("invalid expression type %q for range Query, must be Scalar or instant Vector", parser.DocumentedType(expr.Type()))
 	}
 
-	lplan := logicalplan.New(expr, start, end)
+	timers := stats.NewQueryTimers()
+	planTimer := timers.GetTimer(stats.QueryPreparationTime).Start()
+
+	sampleTracker := query.NewSampleTracker(start, end, step)
+	memoryTracker := query.NewMemoryTracker(e.memoryLimitBytes)
+	queryOpts := e.queryOptions(start, end, step, sampleTracker, memoryTracker)
+
+	lplan := logicalplan.New(expr, queryOpts)
 	lplan = lplan.Optimize(e.logicalOptimizers)
 
-	exec, err := execution.New(lplan.Expr(), q, start, end, step, e.lookbackDelta)
+	exec, err := execution.New(lplan.Expr(), q, queryOpts)
+	planTimer.Stop()
 	if e.triggerFallback(err) {
 		e.queries.WithLabelValues("true").Inc()
+		e.fallbacks.WithLabelValues(parse.Reason(err)).Inc()
 		return e.prom.NewRangeQuery(q, opts, qs, start, end, step)
 	}
 	e.queries.WithLabelValues("false").Inc()
@@ -211,25 +392,80 @@ func (e *compatibilityEngine) NewRangeQuery(q storage.Queryable, opts *promql.Qu
 	}
 
 	return &compatibilityQuery{
-		Query:  &Query{exec: exec},
-		engine: e,
-		expr:   expr,
-		t:      RangeQuery,
+		Query:              &Query{exec: exec, enableAnalysis: e.enableAnalysis},
+		engine:             e,
+		expr:               expr,
+		start:              start,
+		end:                end,
+		step:               step,
+		t:                  RangeQuery,
+		timers:             timers,
+		sampleTracker:      sampleTracker,
+		sampleLimiter:      queryOpts.SampleLimiter,
+		memoryTracker:      memoryTracker,
+		warnings:           queryOpts.Warnings,
+		enablePerStepStats: e.enablePerStepStats && opts != nil && opts.EnablePerStepStats,
 	}, nil
 }
 
+func (e *compatibilityEngine) queryOptions(start, end time.Time, step time.Duration, sampleTracker *query.SampleTracker, memoryTracker *query.MemoryTracker) *query.Options {
+	return &query.Options{
+		Start:                    start,
+		End:                      end,
+		Step:                     step,
+		LookbackDelta:            e.lookbackDelta,
+		NoStepSubqueryIntervalFn: e.noStepSubqueryIntervalFn,
+		Parallelism:              e.parallelism,
+		SampleTracker:            sampleTracker,
+		SampleLimiter:            query.NewSampleLimiter(e.maxSamples),
+		MemoryTracker:            memoryTracker,
+		Warnings:                 query.NewWarnings(),
+		EnableAnalysis:           e.enableAnalysis,
+		EnableTracing:            e.enableTracing,
+		EnablePartialResponse:    e.enablePartialResponse,
+	}
+}
+
 type Query struct {
-	exec model.VectorOperator
+	exec           model.VectorOperator
+	enableAnalysis bool
+}
+
+// Explain returns the physical plan of the query.
+func (q *Query) Explain() *ExplainOutputNode {
+	node := explainOperator(q.exec)
+	return &node
 }
 
-// Explain returns human-readable explanation of the created executor.
-func (q *Query) Explain() string {
-	// TODO(bwplotka): Explain plan and steps.
-	return "not implemented"
+// Analyze returns the physical plan of the query with the execution statistics of
+// each operator. It should be called after the query was executed, and returns nil
+// if analysis was not enabled for the engine.
+func (q *Query) Analyze() *AnalyzeOutputNode {
+	if !q.enableAnalysis {
+		return nil
+	}
+	node := analyzeOperator(q.exec)
+	return &node
 }
 
-func (q *Query) Profile() {
-	// TODO(bwplotka): Return profile.
+// MemoryStatsQuery is implemented by queries which are executed by this engine.
+// Queries which fall back to the Prometheus engine do not implement it.
+type MemoryStatsQuery interface {
+	promql.Query
+
+	// PeakMemoryBytes returns the largest number of bytes which the query held at once
+	// for buffering series and samples. It should be called after the query was executed.
+	PeakMemoryBytes() int64
+
+	// QueryStats returns the statistics of Stats together with the peak memory of the query,
+	// in the format which is logged by the query logger and rendered by the Prometheus API.
+	QueryStats() stats.QueryStats
+}
+
+// QueryStats extends the statistics of the Prometheus engine with the peak memory of a query.
+type QueryStats struct {
+	stats.BuiltinStats
+	PeakMemoryBytes int64 `json:"peakMemoryBytes"`
 }
 
 type compatibilityQuery struct {
@@ -239,6 +475,23 @@ type compatibilityQuery struct {
 	ts     time.Time // Empty for range queries.
 	t      QueryType
 
+	// start, end and step are the parameters of the query which are logged by the query logger.
+	start, end time.Time
+	step       time.Duration
+
+	// resultSort is the order of instant vector results. It is only set
+	// for instant queries with a sort or sort_desc call at the root.
+	resultSort resultSort
+
+	// timers measure the phases of the query. The time spent on planning and
+	// loading series is reported as preparation time, like in Prometheus.
+	timers             *stats.QueryTimers
+	sampleTracker      *query.SampleTracker
+	sampleLimiter      *query.SampleLimiter
+	memoryTracker      *query.MemoryTracker
+	warnings           *query.Warnings
+	enablePerStepStats bool
+
 	cancel context.CancelFunc
 }
 
@@ -248,13 +501,46 @@ func (q *compatibilityQuery) Exec(ctx context.Context) (ret *promql.Result) {
 	ret = &promql.Result{
 		Value: promql.Vector{},
 	}
+	defer func() { q.logQuery(ctx, ret.Err) }()
+	defer q.recordMetrics(time.Now())
+	defer finishSpans(q.exec)
 	defer recoverEngine(q.engine.logger, q.expr, &ret.Err)
+	defer func() {
+		// Vector pools can not return errors, so queries which exceed their memory limit or
+		// release more memory than they hold are cancelled, and the error of the memory
+		// tracker replaces the cancellation error.
+		if err := q.memoryTracker.Err(); err != nil {
+			ret.Value, ret.Err = nil, err
+		}
+		ret.Err = timeoutErr(ret.Err, "query execution")
+		ret.Warnings = q.warnings.Get()
+	}()
 
+	execTimer := q.timers.GetTimer(stats.ExecTotalTime).Start()
+	defer execTimer.Stop()
+
+	if q.engine.timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, q.engine.timeout)
+		defer cancelTimeout()
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	q.cancel = cancel
+	q.memoryTracker.SetCancelFunc(cancel)
+
+	release, err := q.enqueue(ctx)
+	if err != nil {
+		return newErrResult(ret, timeoutErr(err, "query queue"))
+	}
+	defer release()
 
+	evalTimer := q.timers.GetTimer(stats.EvalTotalTime).Start()
+	defer evalTimer.Stop()
+
+	prepareTimer := q.timers.GetTimer(stats.QueryPreparationTime).Start()
 	resultSeries, err := q.Query.exec.Series(ctx)
+	prepareTimer.Stop()
 	if err != nil {
 		return newErrResult(ret, err)
 	}
@@ -263,6 +549,8 @@ func (q *compatibilityQuery) Exec(ctx context.Context) (ret *promql.Result) {
 	for i := 0; i < len(resultSeries); i++ {
 		series[i].Metric = resultSeries[i]
 	}
+
+	innerEvalTimer := q.timers.GetTimer(stats.InnerEvalTime).Start()
 loop:
 	for {
 		select {
@@ -310,11 +598,24 @@ loop:
 						V: vector.Samples[i],
 					})
 				}
+				for i, s := range vector.HistogramIDs {
+					if len(series[s].Points) == 0 {
+						series[s].Points = make([]promql.Point, 0, 121) // Typically 1h of data.
+					}
+					series[s].Points = append(series[s].Points, promql.Point{
+						T: vector.T,
+						H: vector.Histograms[i],
+					})
+				}
 				q.Query.exec.GetPool().PutStepVector(vector)
 			}
 			q.Query.exec.GetPool().PutVectors(r)
 		}
 	}
+	innerEvalTimer.Stop()
+
+	sortTimer := q.timers.GetTimer(stats.ResultSortTime).Start()
+	defer sortTimer.Stop()
 
 	// For range Query we expect always a Matrix value type.
 	if q.t == RangeQuery {
@@ -347,10 +648,12 @@ loop:
 				Metric: series[i].Metric,
 				Point: promql.Point{
 					V: series[i].Points[0].V,
+					H: series[i].Points[0].H,
 					T: q.ts.UnixMilli(),
 				},
 			})
 		}
+		q.resultSort.sort(vector)
 		result = vector
 	case parser.ValueTypeScalar:
 		v := math.NaN()
@@ -366,6 +669,122 @@ loop:
 	return ret
 }
 
+type resultSort int
+
+const (
+	noSort resultSort = iota
+	sortAsc
+	sortDesc
+)
+
+func newResultSort(expr parser.Expr) resultSort {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return newResultSort(e.Expr)
+	case *parser.StepInvariantExpr:
+		return newResultSort(e.Expr)
+	case *parser.Call:
+		switch e.Func.Name {
+		case "sort":
+			return sortAsc
+		case "sort_desc":
+			return sortDesc
+		}
+	}
+	return noSort
+}
+
+// sort orders the vector the same way as the sort and sort_desc functions
+// in Prometheus. Since the sort is not stable, the vector is first ordered by
+// labels, which is the order in which Prometheus usually receives samples.
+func (s resultSort) sort(vector promql.Vector) {
+	if s == noSort {
+		return
+	}
+	sort.SliceStable(vector, func(i, j int) bool {
+		return labels.Compare(vector[i].Metric, vector[j].Metric) < 0
+	})
+
+	// NaN should sort to the bottom, so take descending sort with NaN first and
+	// reverse it.
+	// Copy from https://github.com/prometheus/prometheus/blob/v0.40.1/promql/functions.go#L345.
+	if s == sortAsc {
+		sort.Sort(sort.Reverse(vectorByReverseValue(vector)))
+	} else {
+		sort.Sort(sort.Reverse(vectorByValue(vector)))
+	}
+}
+
+type vectorByValue promql.Vector
+
+func (s vectorByValue) Len() int { return len(s) }
+func (s vectorByValue) Less(i, j int) bool {
+	if math.IsNaN(s[i].V) {
+		return true
+	}
+	return s[i].V < s[j].V
+}
+func (s vectorByValue) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+type vectorByReverseValue promql.Vector
+
+func (s vectorByReverseValue) Len() int { return len(s) }
+func (s vectorByReverseValue) Less(i, j int) bool {
+	if math.IsNaN(s[i].V) {
+		return true
+	}
+	return s[i].V > s[j].V
+}
+func (s vectorByReverseValue) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// recordMetrics records the duration of the query, and the number of samples and series it selected.
+func (q *compatibilityQuery) recordMetrics(start time.Time) {
+	q.engine.queryDuration.WithLabelValues(q.t.String()).Observe(time.Since(start).Seconds())
+	q.engine.samples.Add(float64(q.sampleTracker.TotalSamples()))
+	q.engine.series.Add(float64(q.sampleTracker.TotalSeries()))
+}
+
+// enqueue waits until the query can be executed. The query is recorded in the active
+// query tracker, which limits the number of concurrent queries, and reserves workers
+// from the worker budget of the engine. The returned function has to be called once
+// the query finished.
+func (q *compatibilityQuery) enqueue(ctx context.Context) (release func(), err error) {
+	queueTimer := q.timers.GetTimer(stats.ExecQueueTime).Start()
+	defer queueTimer.Stop()
+
+	var releaseFuncs []func()
+	release = func() {
+		for i := len(releaseFuncs) - 1; i >= 0; i-- {
+			releaseFuncs[i]()
+		}
+	}
+	if tracker := q.engine.activeQueryTracker; tracker != nil {
+		queryIndex, err := tracker.Insert(ctx, q.String())
+		if err != nil {
+			return nil, err
+		}
+		releaseFuncs = append(releaseFuncs, func() { tracker.Delete(queryIndex) })
+	}
+	if budget := q.engine.workerBudget; budget != nil {
+		parallelism := int64(q.engine.parallelism)
+		if err := budget.Acquire(ctx, parallelism); err != nil {
+			release()
+			return nil, err
+		}
+		releaseFuncs = append(releaseFuncs, func() { budget.Release(parallelism) })
+	}
+	return release, nil
+}
+
+// timeoutErr converts errors caused by an exceeded deadline into the timeout error
+// of the Prometheus engine for the given environment.
+func timeoutErr(err error, env string) error {
+	if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		return promql.ErrQueryTimeout(env)
+	}
+	return err
+}
+
 func newErrResult(r *promql.Result, err error) *promql.Result {
 	if r == nil {
 		r = &promql.Result{}
@@ -378,7 +797,24 @@ func newErrResult(r *promql.Result, err error) *promql.Result {
 
 func (q *compatibilityQuery) Statement() parser.Statement { return nil }
 
-func (q *compatibilityQuery) Stats() *stats.Statistics { return &stats.Statistics{} }
+func (q *compatibilityQuery) Stats() *stats.Statistics {
+	return &stats.Statistics{
+		Timers:  q.timers,
+		Samples: q.sampleTracker.QuerySamples(q.enablePerStepStats, q.sampleLimiter),
+	}
+}
+
+// PeakMemoryBytes returns the highest number of bytes the query held at once for buffering series and samples.
+func (q *compatibilityQuery) PeakMemoryBytes() int64 {
+	return q.memoryTracker.PeakBytes()
+}
+
+func (q *compatibilityQuery) QueryStats() stats.QueryStats {
+	return &QueryStats{
+		BuiltinStats:    stats.NewQueryStats(q.Stats()).Builtin(),
+		PeakMemoryBytes: q.PeakMemoryBytes(),
+	}
+}
 
 func (q *compatibilityQuery) Close() { q.Cancel() }
 
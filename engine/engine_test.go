@@ -5,13 +5,16 @@ package engine_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"os"
 	"reflect"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,17 +22,28 @@ import (
 
 	"github.com/efficientgo/core/testutil"
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/timestamp"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/util/stats"
+	"github.com/prometheus/prometheus/util/teststorage"
+	v1 "github.com/prometheus/prometheus/web/api/v1"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/goleak"
 
 	"github.com/thanos-community/promql-engine/engine"
+	"github.com/thanos-community/promql-engine/execution/parse"
 	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 func TestMain(m *testing.M) {
@@ -290,6 +304,59 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 					http_requests_total{pod="nginx-2"} 1`,
 			query: "timestamp(http_requests_total)",
 		},
+		{
+			name: "timestamp with steps which are not aligned with samples",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "timestamp(http_requests_total)",
+			step:  17 * time.Second,
+		},
+		{
+			name: "timestamp of a selector in parentheses with @ modifier",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "timestamp((http_requests_total @ 100))",
+		},
+		{
+			name: "timestamp of a function",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "timestamp(abs(http_requests_total))",
+			step:  17 * time.Second,
+		},
+		{
+			name: "round",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1.5+0.7x15
+					http_requests_total{pod="nginx-2"} -2.5-0.3x18`,
+			query: "round(http_requests_total)",
+		},
+		{
+			name: "round with to_nearest",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1.5+0.7x15
+					http_requests_total{pod="nginx-2"} -2.5-0.3x18`,
+			query: "round(http_requests_total, 0.5)",
+		},
+		{
+			name: "round with to_nearest from a scalar",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1.5+0.7x15
+					http_requests_total{pod="nginx-2"} -2.5-0.3x18
+					nearest{} 1+1x15`,
+			query: "round(http_requests_total, scalar(nearest))",
+		},
+		{
+			name: "sgn",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} -2+1x15
+					http_requests_total{pod="nginx-2"} 0
+					http_requests_total{pod="nginx-3"} 4-1x18`,
+			query: "sgn(http_requests_total)",
+		},
 		{
 			name: "rad",
 			load: `load 30s
@@ -430,6 +497,356 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 					http_requests_total{pod="nginx-2", ns="a"} 1+1x15`,
 			query: `avg without (pod, ns) (avg_over_time(http_requests_total[2m]))`,
 		},
+		{
+			name: "count_values",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-3", ns="b"} 1+2x20
+					http_requests_total{pod="nginx-4", ns="b"} 2+2x10`,
+			query: `count_values("value", http_requests_total)`,
+		},
+		{
+			name: "count_values by",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-3", ns="b"} 1+2x20
+					http_requests_total{pod="nginx-4", ns="b"} 2+2x10`,
+			query: `count_values by (ns) ("value", http_requests_total)`,
+		},
+		{
+			name: "count_values without",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-3", ns="b"} 1+2x20
+					http_requests_total{pod="nginx-4", ns="b"} 2+2x10`,
+			query: `count_values without (pod) ("value", http_requests_total)`,
+		},
+		{
+			name: "count_values overriding an existing label",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-3", ns="b"} 1+2x20`,
+			query: `count_values by (pod) ("pod", http_requests_total)`,
+		},
+		{
+			name: "count_values over a function",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-3", ns="b"} 1+2x20`,
+			query: `count_values("rate", rate(http_requests_total[1m]))`,
+		},
+		{
+			name: "label_replace",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x20`,
+			query: `label_replace(http_requests_total, "replica", "$1", "pod", "nginx-(.*)")`,
+		},
+		{
+			name: "label_replace with no match",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x20`,
+			query: `label_replace(http_requests_total, "replica", "$1", "pod", "envoy-(.*)")`,
+		},
+		{
+			name: "label_replace removing a label",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x20`,
+			query: `label_replace(http_requests_total, "ns", "", "", "")`,
+		},
+		{
+			name: "label_replace with duplicate labelsets",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x20`,
+			query: `label_replace(http_requests_total, "pod", "x", "", "")`,
+		},
+		{
+			name: "label_replace with duplicate labelsets at different times",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x1 _x6
+					http_requests_total{pod="nginx-2"} _x6 1+2x1`,
+			query: `label_replace(http_requests_total, "pod", "x", "", "")`,
+		},
+		{
+			name: "aggregation over label_replace",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x20
+					http_requests_total{pod="envoy-1", ns="b"} 1+3x20`,
+			query: `sum by (app) (label_replace(rate(http_requests_total[1m]), "app", "$1", "pod", "(.*)-.*"))`,
+		},
+		{
+			name: "label_join",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x20`,
+			query: `label_join(http_requests_total, "label", "-", "__name__", "ns", "pod")`,
+		},
+		{
+			name: "label_join overriding a label",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x20`,
+			query: `label_join(http_requests_total, "pod", ",", "ns", "pod")`,
+		},
+		{
+			name: "sort",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x20`,
+			query: `sort(http_requests_total)`,
+		},
+		{
+			name: "sort_desc",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x20`,
+			query: `sort_desc(rate(http_requests_total[1m]))`,
+		},
+		{
+			name: "day_of_month",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+86400x40
+					http_requests_total{pod="nginx-2"} 1670000000+100000x40`,
+			query: "day_of_month(http_requests_total)",
+		},
+		{
+			name: "day_of_week",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+86400x40
+					http_requests_total{pod="nginx-2"} 1670000000+100000x40`,
+			query: "day_of_week(http_requests_total)",
+		},
+		{
+			name: "day_of_year",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+86400x40
+					http_requests_total{pod="nginx-2"} 1670000000+100000x40`,
+			query: "day_of_year(http_requests_total)",
+		},
+		{
+			name: "days_in_month",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+86400x40
+					http_requests_total{pod="nginx-2"} 1670000000+100000x40`,
+			query: "days_in_month(http_requests_total)",
+		},
+		{
+			name: "month",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+86400x40
+					http_requests_total{pod="nginx-2"} 1670000000+100000x40`,
+			query: "month(http_requests_total)",
+		},
+		{
+			name: "year",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+86400x40
+					http_requests_total{pod="nginx-2"} 1670000000+100000x40`,
+			query: "year(http_requests_total)",
+		},
+		{
+			name: "hour",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+3600x40
+					http_requests_total{pod="nginx-2"} 1670000000+4000x40`,
+			query: "hour(http_requests_total)",
+		},
+		{
+			name: "minute",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+60x40
+					http_requests_total{pod="nginx-2"} 1670000000+100x40`,
+			query: "minute(http_requests_total)",
+		},
+		{
+			name:  "minute without arguments",
+			load:  ``,
+			query: "minute()",
+			start: time.Unix(0, 0),
+			end:   time.Unix(7200, 0),
+			step:  5 * time.Minute,
+		},
+		{
+			name:  "hour without arguments",
+			load:  ``,
+			query: "hour()",
+			start: time.Unix(0, 0),
+			end:   time.Unix(172800, 0),
+			step:  time.Hour,
+		},
+		{
+			name:  "day_of_week without arguments",
+			load:  ``,
+			query: "day_of_week()",
+			start: time.Unix(0, 0),
+			end:   time.Unix(864000, 0),
+			step:  6 * time.Hour,
+		},
+		{
+			name:  "aggregation of a calendar function without arguments",
+			load:  ``,
+			query: "sum(days_in_month())",
+			start: time.Unix(0, 0),
+			end:   time.Unix(864000, 0),
+			step:  6 * time.Hour,
+		},
+		{
+			name: "absent with present series",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3`,
+			query: `absent(http_requests_total)`,
+		},
+		{
+			name: "absent with gaps",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3`,
+			query: `absent(http_requests_total{pod="nginx-1"})`,
+		},
+		{
+			name: "absent with missing series",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3`,
+			query: `absent(nonexistent{job="myjob", instance=~".*"})`,
+		},
+		{
+			name: "absent with duplicate matchers",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3`,
+			query: `absent(nonexistent{job="myjob", job="otherjob", env="prod"})`,
+		},
+		{
+			name: "absent of a function",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3`,
+			query: `absent(rate(nonexistent{job="myjob"}[1m]))`,
+		},
+		{
+			name: "absent_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3`,
+			query: `absent_over_time(http_requests_total{pod="nginx-1"}[1m])`,
+		},
+		{
+			name: "absent_over_time with missing series",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3`,
+			query: `absent_over_time(nonexistent{job="myjob"}[1m])`,
+		},
+		{
+			name: "absent_over_time with present series",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3`,
+			query: `absent_over_time(http_requests_total{pod="nginx-2"}[5m])`,
+		},
+		{
+			name: "absent_over_time with subquery",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3`,
+			query: `absent_over_time(http_requests_total{pod="nginx-1"}[1m:15s])`,
+		},
+		{
+			name: "quantile_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `quantile_over_time(0.9, http_requests_total[2m])`,
+		},
+		{
+			name: "quantile_over_time with negative quantile",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `quantile_over_time(-1, http_requests_total[2m])`,
+		},
+		{
+			name: "quantile_over_time with quantile larger than 1",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `quantile_over_time(2, http_requests_total[2m])`,
+		},
+		{
+			name: "quantile_over_time with a quantile which changes between steps",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9
+					quantile{} 0.1+0.1x8`,
+			query: `quantile_over_time(scalar(quantile), http_requests_total[2m])`,
+		},
+		{
+			name: "quantile_over_time with subquery",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `quantile_over_time(0.5, rate(http_requests_total[1m])[2m:30s])`,
+		},
+		{
+			name: "predict_linear",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `predict_linear(http_requests_total[2m], 3600)`,
+		},
+		{
+			name: "predict_linear with offset and a negative duration",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `predict_linear(http_requests_total[2m] offset 30s, -60)`,
+		},
+		{
+			name: "predict_linear with subquery",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `predict_linear(rate(http_requests_total[1m])[2m:30s], 600)`,
+		},
+		{
+			name: "holt_winters",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `holt_winters(http_requests_total[2m], 0.5, 0.1)`,
+		},
+		{
+			name: "holt_winters with high smoothing and trend factors",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `holt_winters(http_requests_total[3m], 0.9, (0.8))`,
+		},
+		{
+			name: "holt_winters with invalid smoothing factor",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `holt_winters(http_requests_total[2m], 1, 0.5)`,
+		},
+		{
+			name: "holt_winters with invalid trend factor in subquery",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x4 _x4 1+1x8
+					http_requests_total{pod="nginx-2", ns="b"} 1+2x3 10 4 2 8 1 9`,
+			query: `holt_winters(rate(http_requests_total[1m])[2m:30s], 0.5, -0.1)`,
+		},
 		{
 			name: "query in the future",
 			load: `load 30s
@@ -923,6 +1340,13 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 					http_requests_total{pod="nginx-2"} 1+2x18`,
 			query: `+http_requests_total`,
 		},
+		{
+			name: "aggregation of unary sub operation in binary operation",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `sum((-http_requests_total) ^ 2)`,
+		},
 		{
 			name: "vector positive offset",
 			load: `load 30s
@@ -1071,6 +1495,56 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 	+ on() group_left()
 	sum(http_requests_total{ns="nginx"})`,
 		},
+		{
+			name: "subquery",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x40
+					http_requests_total{pod="nginx-2"} 1+2x40`,
+			query: "max_over_time(rate(http_requests_total[1m])[2m:30s])",
+		},
+		{
+			name: "subquery with different step than query",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x40
+					http_requests_total{pod="nginx-2"} 1+2x40`,
+			query: "sum_over_time(sum(http_requests_total)[90s:20s])",
+			step:  45 * time.Second,
+		},
+		{
+			name: "subquery with offset",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x40
+					http_requests_total{pod="nginx-2"} 1+2x40`,
+			query: "count_over_time(http_requests_total[1m:15s] offset 1m)",
+		},
+		{
+			name: "subquery with @ modifier",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x40
+					http_requests_total{pod="nginx-2"} 1+2x40`,
+			query: "avg_over_time(http_requests_total[2m:30s] @ 180)",
+		},
+		{
+			name: "subquery with @ modifier in inner selector",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x40
+					http_requests_total{pod="nginx-2"} 1+2x40`,
+			query: "min_over_time((http_requests_total @ 120 + http_requests_total)[1m:10s])",
+		},
+		{
+			name: "nested subquery",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x40
+					http_requests_total{pod="nginx-2"} 1+2x40`,
+			query: "max_over_time(deriv(rate(http_requests_total[1m])[2m:30s])[3m:1m])",
+		},
+		{
+			name: "last_over_time subquery keeps the metric name",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x40
+					http_requests_total{pod="nginx-2"} 1+2x40`,
+			query: "last_over_time(http_requests_total[1m:20s])",
+		},
 		// Result is correct but this likely fails due to https://github.com/golang/go/issues/12025.
 		// TODO(saswatamcode): Test NaN cases separately. https://github.com/thanos-community/promql-engine/issues/88
 		// {
@@ -1454,9 +1928,17 @@ func TestDistributedAggregations(t *testing.T) {
 		name           string
 		query          string
 		expectFallback bool
+		// rangeQueries is set when remote engines evaluate a range even for instant queries.
+		rangeQueries bool
 	}{
 		{name: "sum", query: `sum by (pod) (bar)`},
 		{name: "avg", query: `avg by (pod) (bar)`},
+		{name: "avg without", query: `avg without (pod) (bar)`},
+		{name: "avg in function", query: `abs(avg(bar))`},
+		{name: "stddev", query: `stddev by (pod) (bar)`},
+		{name: "stdvar", query: `stdvar without (region) (rate(bar[1m]))`},
+		{name: "stddev of negated selector", query: `stddev(-bar)`},
+		{name: "quantile", query: `quantile by (pod) (0.9, bar)`},
 		{name: "count", query: `count by (pod) (bar)`},
 		{name: "group", query: `group by (pod) (bar)`},
 		{name: "topk", query: `topk by (pod) (1, bar)`},
@@ -1464,7 +1946,9 @@ func TestDistributedAggregations(t *testing.T) {
 		{name: "double aggregation", query: `max by (pod) (sum by (pod) (bar))`},
 		{name: "aggregation with function operand", query: `sum by (pod) (rate(bar[1m]))`},
 		{name: "binary aggregation", query: `sum by (region) (bar) / sum by (pod) (bar)`},
-		{name: "unsupported aggregation", query: `count_values("pod", bar)`, expectFallback: true},
+		{name: "count_values", query: `count_values("pod", bar)`},
+		{name: "subquery", query: `max_over_time(sum by (pod) (bar)[1m:30s])`, rangeQueries: true},
+		{name: "subquery count", query: `count_over_time(sum(bar)[2m:30s])`, rangeQueries: true},
 	}
 
 	allSeries := storageWithSeries(append(ssetA, ssetB...)...)
@@ -1489,22 +1973,542 @@ func TestDistributedAggregations(t *testing.T) {
 			roundValues(distResult)
 			testutil.Equals(t, promResult, distResult)
 		})
+		t.Run(tcase.name+" instant", func(t *testing.T) {
+			distOpts := localOpts
+			distOpts.DisableFallback = !tcase.expectFallback
+			remoteEngines := []*instantQueryRecordingEngine{
+				{RemoteEngine: engine.NewLocalEngine(localOpts, storageWithSeries(ssetA...))},
+				{RemoteEngine: engine.NewLocalEngine(localOpts, storageWithSeries(ssetB...))},
+			}
+			distEngine := engine.NewDistributedEngine(distOpts, api.NewStaticEndpoints([]api.RemoteEngine{remoteEngines[0], remoteEngines[1]}))
+			distQry, err := distEngine.NewInstantQuery(allSeries, nil, tcase.query, end)
+			testutil.Ok(t, err)
+
+			distResult := distQry.Exec(context.Background())
+			promEngine := promql.NewEngine(localOpts.EngineOpts)
+			promQry, err := promEngine.NewInstantQuery(allSeries, nil, tcase.query, end)
+			testutil.Ok(t, err)
+			promResult := promQry.Exec(context.Background())
+
+			// The order of samples in instant vectors is not defined.
+			sortByLabels(promResult)
+			sortByLabels(distResult)
+			roundValues(promResult)
+			roundValues(distResult)
+			testutil.Equals(t, promResult, distResult)
+			for _, e := range remoteEngines {
+				testutil.Equals(t, tcase.rangeQueries, e.rangeQueries.Load() > 0)
+			}
+		})
 	}
 }
 
-func TestBinopEdgeCases(t *testing.T) {
-	opts := promql.EngineOpts{
-		Timeout:              1 * time.Hour,
-		MaxSamples:           1e10,
-		EnableNegativeOffset: true,
-		EnableAtModifier:     true,
+func TestDistributedEnginePruning(t *testing.T) {
+	localOpts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
 	}
 
-	series := []storage.Series{
+	start := time.Unix(0, 0)
+	end := time.Unix(120, 0)
+	step := time.Second * 30
+
+	east := []storage.Series{
 		newMockSeries(
-			[]string{labels.MetricName, "foo"},
-			[]int64{0, 30000, 60000, 1200000, 1500000, 1800000},
-			[]float64{1, 2, 3, 4, 5, 6},
+			[]string{labels.MetricName, "bar", "region", "east", "pod", "nginx-1"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{1, 2, 3, 4, 5},
+		),
+	}
+	west := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "west-1", "pod", "nginx-1"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{3, 4, 5, 6, 7},
+		),
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "west-2", "pod", "nginx-2"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{4, 5, 6, 7, 8},
+		),
+	}
+
+	queries := []struct {
+		name  string
+		query string
+	}{
+		{name: "selector matching all engines", query: `sum by (pod) (bar)`},
+		{name: "selector matching one engine", query: `sum by (pod) (bar{region=~"west.*"})`},
+		{name: "selector matching one label set", query: `sum by (pod) (bar{region="west-2"})`},
+		{name: "selector matching no engine", query: `sum by (pod) (bar{region="north"})`},
+	}
+
+	allSeries := storageWithMatchingSeries(append(east, west...)...)
+	for _, tcase := range queries {
+		t.Run(tcase.name, func(t *testing.T) {
+			distOpts := localOpts
+			distOpts.DisableFallback = true
+			distEngine := engine.NewDistributedEngine(distOpts, api.NewStaticEndpoints([]api.RemoteEngine{
+				newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithMatchingSeries(east...)), labels.FromStrings("region", "east")),
+				newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithMatchingSeries(west...)), labels.FromStrings("region", "west-1"), labels.FromStrings("region", "west-2")),
+			}))
+			distQry, err := distEngine.NewRangeQuery(allSeries, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+
+			distResult := distQry.Exec(context.Background())
+			promEngine := promql.NewEngine(localOpts.EngineOpts)
+			promQry, err := promEngine.NewRangeQuery(allSeries, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+			promResult := promQry.Exec(context.Background())
+
+			roundValues(promResult)
+			roundValues(distResult)
+			testutil.Equals(t, promResult, distResult)
+		})
+	}
+}
+
+func TestDistributedVariance(t *testing.T) {
+	localOpts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+	}
+
+	start := time.Unix(0, 0)
+	end := time.Unix(120, 0)
+	step := time.Second * 30
+
+	constantSeries := func(value float64, lbls ...string) storage.Series {
+		return newMockSeries(
+			append([]string{labels.MetricName, "bar"}, lbls...),
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{value, value, value, value, value},
+		)
+	}
+	east := []storage.Series{
+		constantSeries(0.1, "region", "east", "pod", "nginx-1"),
+		constantSeries(0.3, "region", "east", "pod", "nginx-2"),
+		constantSeries(1e9+1, "region", "east", "pod", "nginx-5", "kind", "large"),
+		constantSeries(1e9+2, "region", "east", "pod", "nginx-6", "kind", "large"),
+	}
+	west := []storage.Series{
+		constantSeries(0.1, "region", "west", "pod", "nginx-1"),
+		constantSeries(0.1, "region", "west", "pod", "nginx-3"),
+		constantSeries(0.3, "region", "west", "pod", "nginx-2"),
+		constantSeries(0.3, "region", "west", "pod", "nginx-4"),
+		constantSeries(1e9+3, "region", "west", "pod", "nginx-7", "kind", "large"),
+		constantSeries(1e9+4, "region", "west", "pod", "nginx-8", "kind", "large"),
+	}
+
+	queries := []string{
+		`stddev(bar{pod=~"nginx-(1|3)"})`,
+		`stdvar(bar{pod=~"nginx-(1|3)"})`,
+		`stddev(bar{pod=~"nginx-(2|4)"})`,
+		`stdvar(bar{pod=~"nginx-(2|4)"})`,
+		// Values of a large magnitude with a low variance lose their variance
+		// when it is calculated from sums of squares.
+		`stddev(bar{kind="large"})`,
+		`stdvar(bar{kind="large"})`,
+		`stdvar by (kind) (bar)`,
+	}
+
+	allSeries := storageWithMatchingSeries(append(east, west...)...)
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			distOpts := localOpts
+			distOpts.DisableFallback = true
+			distEngine := engine.NewDistributedEngine(distOpts, api.NewStaticEndpoints([]api.RemoteEngine{
+				newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithMatchingSeries(east...)), labels.FromStrings("region", "east")),
+				newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithMatchingSeries(west...)), labels.FromStrings("region", "west")),
+			}))
+			distQry, err := distEngine.NewRangeQuery(allSeries, nil, query, start, end, step)
+			testutil.Ok(t, err)
+
+			distResult := distQry.Exec(context.Background())
+			promEngine := promql.NewEngine(localOpts.EngineOpts)
+			promQry, err := promEngine.NewRangeQuery(allSeries, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			promResult := promQry.Exec(context.Background())
+
+			// Values are not rounded, since errors of the variance are not bounded by its value.
+			testutil.Equals(t, promResult, distResult)
+		})
+	}
+}
+
+func TestDistributedDeduplication(t *testing.T) {
+	localOpts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:       1 * time.Hour,
+			MaxSamples:    1e10,
+			LookbackDelta: 10 * time.Second,
+		},
+	}
+
+	start := time.Unix(0, 0)
+	end := time.Unix(120, 0)
+	step := time.Second * 30
+
+	east := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "east", "pod", "nginx-1"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{1, 2, 3, 4, 5},
+		),
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "east", "pod", "nginx-2"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{2, 3, 4, 5, 6},
+		),
+	}
+	// Each replica of the east region misses some of its first samples. The series of remote
+	// engines carry their replica label, which is removed by deduplication.
+	eastReplicaA := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "east", "pod", "nginx-1", "replica", "a"},
+			[]int64{30000, 60000, 90000, 120000},
+			[]float64{2, 3, 4, 5},
+		),
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "east", "pod", "nginx-2", "replica", "a"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{2, 3, 4, 5, 6},
+		),
+	}
+	eastReplicaB := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "east", "pod", "nginx-1", "replica", "b"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{1, 2, 3, 4, 5},
+		),
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "east", "pod", "nginx-2", "replica", "b"},
+			[]int64{60000, 90000, 120000},
+			[]float64{4, 5, 6},
+		),
+	}
+	west := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "west", "pod", "nginx-1"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{3, 4, 5, 6, 7},
+		),
+	}
+	westReplica := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "west", "pod", "nginx-1", "replica", "a"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{3, 4, 5, 6, 7},
+		),
+	}
+
+	queries := []struct {
+		name  string
+		query string
+	}{
+		{name: "selector", query: `bar`},
+		{name: "function", query: `rate(bar[1m])`},
+		{name: "sum", query: `sum by (pod) (bar)`},
+		{name: "count", query: `count by (pod) (bar)`},
+		{name: "topk", query: `topk by (pod) (1, bar)`},
+		{name: "selector matching replicas", query: `sum by (pod) (bar{region="east"})`},
+	}
+
+	allSeries := storageWithMatchingSeries(append(east, west...)...)
+	for _, tcase := range queries {
+		t.Run(tcase.name, func(t *testing.T) {
+			distOpts := localOpts
+			distOpts.DisableFallback = true
+			distOpts.ReplicaLabels = []string{"replica"}
+			distEngine := engine.NewDistributedEngine(distOpts, api.NewStaticEndpoints([]api.RemoteEngine{
+				newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithMatchingSeries(eastReplicaA...)), labels.FromStrings("region", "east", "replica", "a")),
+				newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithMatchingSeries(eastReplicaB...)), labels.FromStrings("region", "east", "replica", "b")),
+				newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithMatchingSeries(westReplica...)), labels.FromStrings("region", "west", "replica", "a")),
+			}))
+			distQry, err := distEngine.NewRangeQuery(allSeries, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+
+			distResult := distQry.Exec(context.Background())
+			promEngine := promql.NewEngine(localOpts.EngineOpts)
+			promQry, err := promEngine.NewRangeQuery(allSeries, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+			promResult := promQry.Exec(context.Background())
+
+			roundValues(promResult)
+			roundValues(distResult)
+			testutil.Equals(t, promResult, distResult)
+		})
+	}
+}
+
+func TestDistributedDeduplicationReplicaSwitch(t *testing.T) {
+	localOpts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:       1 * time.Hour,
+			MaxSamples:    1e10,
+			LookbackDelta: 10 * time.Second,
+		},
+	}
+
+	start := time.Unix(0, 0)
+	end := time.Unix(240, 0)
+	step := time.Second * 30
+
+	// Replica a stops after 60s. Replica b is only used once the penalty from
+	// the last sample of replica a has passed, so that its samples are not mixed
+	// with samples of replica a which were scraped at different times.
+	replicaA, err := promql.NewTest(t, `load 30s
+		bar{pod="nginx-1", replica="a"} 1 2 3`)
+	testutil.Ok(t, err)
+	defer replicaA.Close()
+	testutil.Ok(t, replicaA.Run())
+
+	replicaB, err := promql.NewTest(t, `load 30s
+		bar{pod="nginx-1", replica="b"} _ 2.5 3.5 4.5 5.5 6.5 7.5 8.5 9.5`)
+	testutil.Ok(t, err)
+	defer replicaB.Close()
+	testutil.Ok(t, replicaB.Run())
+
+	distOpts := localOpts
+	distOpts.DisableFallback = true
+	distOpts.ReplicaLabels = []string{"replica"}
+	distEngine := engine.NewDistributedEngine(distOpts, api.NewStaticEndpoints([]api.RemoteEngine{
+		newEngineWithLabelSets(engine.NewLocalEngine(localOpts, replicaA.Storage()), labels.FromStrings("replica", "a")),
+		newEngineWithLabelSets(engine.NewLocalEngine(localOpts, replicaB.Storage()), labels.FromStrings("replica", "b")),
+	}))
+	distQry, err := distEngine.NewRangeQuery(replicaA.Storage(), nil, `bar`, start, end, step)
+	testutil.Ok(t, err)
+	distResult := distQry.Exec(context.Background())
+	testutil.Ok(t, distResult.Err)
+
+	expected := promql.Matrix{
+		promql.Series{
+			Metric: labels.FromStrings(labels.MetricName, "bar", "pod", "nginx-1"),
+			Points: []promql.Point{
+				{T: 0, V: 1}, {T: 30000, V: 2}, {T: 60000, V: 3},
+				{T: 150000, V: 6.5}, {T: 180000, V: 7.5}, {T: 210000, V: 8.5}, {T: 240000, V: 9.5},
+			},
+		},
+	}
+	testutil.Equals(t, expected, distResult.Value)
+}
+
+func TestDistributedPartialResponse(t *testing.T) {
+	localOpts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+	}
+
+	start := time.Unix(0, 0)
+	end := time.Unix(120, 0)
+	step := time.Second * 30
+
+	east := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "east", "pod", "nginx-1"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{1, 2, 3, 4, 5},
+		),
+	}
+	west := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "west", "pod", "nginx-1"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{3, 4, 5, 6, 7},
+		),
+	}
+	remoteErr := errors.New("remote engine unavailable")
+
+	for _, qs := range []string{`sum by (pod) (bar)`, `rate(bar[1m])`} {
+		t.Run(qs, func(t *testing.T) {
+			newEngine := func(enablePartialResponse bool) v1.QueryEngine {
+				distOpts := localOpts
+				distOpts.DisableFallback = true
+				distOpts.EnablePartialResponse = enablePartialResponse
+				return engine.NewDistributedEngine(distOpts, api.NewStaticEndpoints([]api.RemoteEngine{
+					newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithSeries(east...)), labels.FromStrings("region", "east")),
+					&failingEngine{
+						RemoteEngine: newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithSeries(west...)), labels.FromStrings("region", "west")),
+						err:          remoteErr,
+					},
+				}))
+			}
+			allSeries := storageWithSeries(append(east, west...)...)
+
+			distQry, err := newEngine(false).NewRangeQuery(allSeries, nil, qs, start, end, step)
+			testutil.Ok(t, err)
+			distResult := distQry.Exec(context.Background())
+			testutil.Assert(t, errors.Is(distResult.Err, remoteErr), "expected remote error, got %v", distResult.Err)
+
+			distQry, err = newEngine(true).NewRangeQuery(allSeries, nil, qs, start, end, step)
+			testutil.Ok(t, err)
+			distResult = distQry.Exec(context.Background())
+			testutil.Ok(t, distResult.Err)
+			testutil.Equals(t, 1, len(distResult.Warnings))
+			testutil.Assert(t, errors.Is(distResult.Warnings[0], remoteErr), "expected remote error warning, got %v", distResult.Warnings[0])
+
+			promEngine := promql.NewEngine(localOpts.EngineOpts)
+			promQry, err := promEngine.NewRangeQuery(storageWithSeries(east...), nil, qs, start, end, step)
+			testutil.Ok(t, err)
+			promResult := promQry.Exec(context.Background())
+
+			roundValues(promResult)
+			roundValues(distResult)
+			distResult.Warnings = nil
+			testutil.Equals(t, promResult, distResult)
+		})
+	}
+}
+
+func TestDistributedRemoteWarnings(t *testing.T) {
+	localOpts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+	}
+
+	start := time.Unix(0, 0)
+	end := time.Unix(120, 0)
+	step := time.Second * 30
+
+	east := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "east", "pod", "nginx-1"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{1, 2, 3, 4, 5},
+		),
+	}
+	west := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "bar", "region", "west", "pod", "nginx-1"},
+			[]int64{0, 30000, 60000, 90000, 120000},
+			[]float64{3, 4, 5, 6, 7},
+		),
+	}
+	remoteWarning := errors.New("remote engine returned partial data")
+
+	for _, enablePartialResponse := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enablePartialResponse=%t", enablePartialResponse), func(t *testing.T) {
+			distOpts := localOpts
+			distOpts.DisableFallback = true
+			distOpts.EnablePartialResponse = enablePartialResponse
+			distEngine := engine.NewDistributedEngine(distOpts, api.NewStaticEndpoints([]api.RemoteEngine{
+				newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithSeries(east...)), labels.FromStrings("region", "east")),
+				&warningEngine{
+					RemoteEngine: newEngineWithLabelSets(engine.NewLocalEngine(localOpts, storageWithSeries(west...)), labels.FromStrings("region", "west")),
+					warning:      remoteWarning,
+				},
+			}))
+			allSeries := storageWithSeries(append(east, west...)...)
+
+			distQry, err := distEngine.NewRangeQuery(allSeries, nil, `sum by (pod) (bar)`, start, end, step)
+			testutil.Ok(t, err)
+			distResult := distQry.Exec(context.Background())
+			testutil.Ok(t, distResult.Err)
+			testutil.Equals(t, storage.Warnings{remoteWarning}, distResult.Warnings)
+
+			promEngine := promql.NewEngine(localOpts.EngineOpts)
+			promQry, err := promEngine.NewRangeQuery(allSeries, nil, `sum by (pod) (bar)`, start, end, step)
+			testutil.Ok(t, err)
+			promResult := promQry.Exec(context.Background())
+
+			distResult.Warnings = nil
+			testutil.Equals(t, promResult, distResult)
+		})
+	}
+}
+
+// warningEngine is a remote engine whose queries succeed with a warning.
+type warningEngine struct {
+	api.RemoteEngine
+	warning error
+}
+
+func (e *warningEngine) NewRangeQuery(opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	qry, err := e.RemoteEngine.NewRangeQuery(opts, qs, start, end, interval)
+	if err != nil {
+		return nil, err
+	}
+	return &warningQuery{Query: qry, warning: e.warning}, nil
+}
+
+type warningQuery struct {
+	promql.Query
+	warning error
+}
+
+func (q *warningQuery) Exec(ctx context.Context) *promql.Result {
+	result := q.Query.Exec(ctx)
+	result.Warnings = append(result.Warnings, q.warning)
+	return result
+}
+
+// failingEngine is a remote engine whose queries fail with err.
+type failingEngine struct {
+	api.RemoteEngine
+	err error
+}
+
+func (e *failingEngine) NewRangeQuery(opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	qry, err := e.RemoteEngine.NewRangeQuery(opts, qs, start, end, interval)
+	if err != nil {
+		return nil, err
+	}
+	return &failingQuery{Query: qry, err: e.err}, nil
+}
+
+type failingQuery struct {
+	promql.Query
+	err error
+}
+
+func (q *failingQuery) Exec(context.Context) *promql.Result {
+	return &promql.Result{Err: q.err}
+}
+
+// engineWithLabelSets is a remote engine with external labels.
+type engineWithLabelSets struct {
+	api.RemoteEngine
+	labelSets []labels.Labels
+}
+
+func newEngineWithLabelSets(e api.RemoteEngine, labelSets ...labels.Labels) *engineWithLabelSets {
+	return &engineWithLabelSets{RemoteEngine: e, labelSets: labelSets}
+}
+
+func (e *engineWithLabelSets) LabelSets() []labels.Labels { return e.labelSets }
+
+// instantQueryRecordingEngine counts the range queries which are created on a remote engine.
+type instantQueryRecordingEngine struct {
+	api.RemoteEngine
+	rangeQueries atomic.Int64
+}
+
+func (e *instantQueryRecordingEngine) NewRangeQuery(opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	e.rangeQueries.Add(1)
+	return e.RemoteEngine.NewRangeQuery(opts, qs, start, end, interval)
+}
+
+func TestBinopEdgeCases(t *testing.T) {
+	opts := promql.EngineOpts{
+		Timeout:              1 * time.Hour,
+		MaxSamples:           1e10,
+		EnableNegativeOffset: true,
+		EnableAtModifier:     true,
+	}
+
+	series := []storage.Series{
+		newMockSeries(
+			[]string{labels.MetricName, "foo"},
+			[]int64{0, 30000, 60000, 1200000, 1500000, 1800000},
+			[]float64{1, 2, 3, 4, 5, 6},
 		),
 		newMockSeries(
 			[]string{labels.MetricName, "bar", "id", "1"},
@@ -1538,6 +2542,167 @@ func TestBinopEdgeCases(t *testing.T) {
 	testutil.Equals(t, oldResult, newResult)
 }
 
+func TestNativeHistograms(t *testing.T) {
+	opts := promql.EngineOpts{
+		Timeout:              1 * time.Hour,
+		MaxSamples:           1e10,
+		EnableNegativeOffset: true,
+		EnableAtModifier:     true,
+	}
+
+	cases := []struct {
+		name         string
+		query        string
+		sortByLabels bool // if true, the series in the result between the old and new engine should be sorted before compared
+	}{
+		{
+			name:  "plain selector",
+			query: "native_histogram_series",
+		},
+		{
+			name:  "rate",
+			query: "rate(native_histogram_series[1m])",
+		},
+		{
+			name:  "increase",
+			query: "increase(native_histogram_series[2m])",
+		},
+		{
+			name:  "delta",
+			query: "delta(native_histogram_series[2m])",
+		},
+		{
+			name:  "sum",
+			query: "sum(native_histogram_series)",
+		},
+		{
+			name:  "sum by label",
+			query: "sum by (foo) (native_histogram_series)",
+		},
+		{
+			name:  "sum rate",
+			query: "sum(rate(native_histogram_series[1m]))",
+		},
+		{
+			name:  "count",
+			query: "count(native_histogram_series)",
+		},
+		{
+			name:  "histogram_count",
+			query: "histogram_count(native_histogram_series)",
+		},
+		{
+			name:  "histogram_sum of rate",
+			query: "histogram_sum(rate(native_histogram_series[1m]))",
+		},
+		{
+			name:  "histogram_fraction",
+			query: "histogram_fraction(0, 2, native_histogram_series)",
+		},
+		{
+			name:  "histogram_quantile",
+			query: "histogram_quantile(0.7, native_histogram_series)",
+		},
+		{
+			name:  "histogram_quantile of sum rate",
+			query: "histogram_quantile(0.9, sum by (foo) (rate(native_histogram_series[1m])))",
+		},
+		{
+			name:         "histogram addition",
+			query:        "native_histogram_series + native_histogram_series",
+			sortByLabels: true,
+		},
+		{
+			name:         "histogram addition with group_left",
+			query:        "native_histogram_series + on () group_left sum(rate(native_histogram_series[1m]))",
+			sortByLabels: true,
+		},
+		{
+			name:         "histogram and float addition",
+			query:        "native_histogram_series + histogram_count(native_histogram_series)",
+			sortByLabels: true,
+		},
+	}
+
+	histograms := tsdb.GenerateTestHistograms(50)
+	storage := teststorage.New(t)
+	defer storage.Close()
+
+	app := storage.Appender(context.Background())
+	for i, h := range histograms {
+		ts := int64(i) * 30 * 1000
+		_, err := app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "foo", "bar"), ts, h)
+		testutil.Ok(t, err)
+
+		// The second series has a counter reset half way through.
+		_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "foo", "baz"), ts, histograms[i%25])
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	start := time.Unix(0, 0)
+	end := time.Unix(1500, 0)
+	step := 30 * time.Second
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+			oldEngine := promql.NewEngine(opts)
+
+			t.Run("range", func(t *testing.T) {
+				q1, err := newEngine.NewRangeQuery(storage, nil, tc.query, start, end, step)
+				testutil.Ok(t, err)
+				defer q1.Close()
+				newResult := q1.Exec(context.Background())
+				testutil.Ok(t, newResult.Err)
+
+				q2, err := oldEngine.NewRangeQuery(storage, nil, tc.query, start, end, step)
+				testutil.Ok(t, err)
+				defer q2.Close()
+				oldResult := q2.Exec(context.Background())
+				testutil.Ok(t, oldResult.Err)
+
+				testutil.Equals(t, oldResult, newResult)
+			})
+			t.Run("instant", func(t *testing.T) {
+				for _, queryTime := range []time.Time{time.Unix(0, 0), time.Unix(600, 0), time.Unix(1000, 0)} {
+					q1, err := newEngine.NewInstantQuery(storage, nil, tc.query, queryTime)
+					testutil.Ok(t, err)
+					defer q1.Close()
+					newResult := q1.Exec(context.Background())
+					testutil.Ok(t, newResult.Err)
+
+					q2, err := oldEngine.NewInstantQuery(storage, nil, tc.query, queryTime)
+					testutil.Ok(t, err)
+					defer q2.Close()
+					oldResult := q2.Exec(context.Background())
+					testutil.Ok(t, oldResult.Err)
+
+					if tc.sortByLabels {
+						sortByLabels(oldResult)
+						sortByLabels(newResult)
+					}
+					testutil.Equals(t, oldResult, newResult)
+				}
+			})
+		})
+	}
+
+	for _, query := range []string{
+		"native_histogram_series - native_histogram_series",
+		"native_histogram_series > native_histogram_series",
+		"native_histogram_series * 2",
+	} {
+		t.Run(query, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+			q, err := newEngine.NewRangeQuery(storage, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q.Close()
+			result := q.Exec(context.Background())
+			testutil.Assert(t, errors.Is(result.Err, parse.ErrNotImplemented), "expected not implemented error, got %v", result.Err)
+		})
+	}
+}
+
 func TestInstantQuery(t *testing.T) {
 	defaultQueryTime := time.Unix(50, 0)
 	// Negative offset and at modifier are enabled by default
@@ -1569,6 +2734,22 @@ func TestInstantQuery(t *testing.T) {
 			queryTime: time.Unix(160, 0),
 			query:     "increase(http_requests_total[1m] offset 1m)",
 		},
+		{
+			name: "subquery",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x40`,
+			queryTime: time.Unix(300, 0),
+			query:     "max_over_time(rate(http_requests_total[1m])[2m:30s])",
+		},
+		{
+			name: "subquery with offset and @ modifier",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x40`,
+			queryTime: time.Unix(300, 0),
+			query:     "sum_over_time(http_requests_total[2m:20s] @ 600 offset 3m)",
+		},
 		{
 			name: "quantile by pod",
 			load: `load 30s
@@ -1663,50 +2844,167 @@ func TestInstantQuery(t *testing.T) {
 			query: "avg(http_requests_total)",
 		},
 		{
-			name: "topk",
+			name: "topk",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="1"} 8
+						http_requests_total{pod="nginx-4", series="2"} 6
+						http_requests_total{pod="nginx-5", series="2"} 8
+						http_requests_total{pod="nginx-6", series="3"} 15
+						http_requests_total{pod="nginx-7", series="3"} 11
+						http_requests_total{pod="nginx-8", series="4"} 22
+						http_requests_total{pod="nginx-9", series="4"} 89`,
+			query: "topk(2, http_requests_total)",
+			// TODO (alanprot): Top/BottomK series order on result. https://github.com/thanos-community/promql-engine/issues/120
+			sortByLabels: true,
+		},
+		{
+			name: "topk by series",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="1"} 8
+						http_requests_total{pod="nginx-4", series="2"} 6
+						http_requests_total{pod="nginx-5", series="2"} 8
+						http_requests_total{pod="nginx-6", series="3"} 15
+						http_requests_total{pod="nginx-7", series="3"} 11
+						http_requests_total{pod="nginx-8", series="4"} 22
+						http_requests_total{pod="nginx-9", series="4"} 89`,
+			query:        "topk(2, http_requests_total) by (series)",
+			sortByLabels: true,
+		},
+		{
+			name: "bottomK",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="1"} 8
+						http_requests_total{pod="nginx-4", series="2"} 6
+						http_requests_total{pod="nginx-5", series="2"} 8
+						http_requests_total{pod="nginx-6", series="3"} 15
+						http_requests_total{pod="nginx-7", series="3"} 11
+						http_requests_total{pod="nginx-8", series="4"} 22
+						http_requests_total{pod="nginx-9", series="4"} 89`,
+			query:        "bottomk(2, http_requests_total)",
+			sortByLabels: true,
+		},
+		{
+			name: "count_values",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="1"} 2
+						http_requests_total{pod="nginx-4", series="2"} 6
+						http_requests_total{pod="nginx-5", series="2"} 6
+						http_requests_total{pod="nginx-6", series="3"} 6`,
+			query:        `count_values by (series) ("value", http_requests_total)`,
+			sortByLabels: true,
+		},
+		{
+			name: "label_replace",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="envoy-1", series="2"} 6`,
+			query: `label_replace(http_requests_total, "app", "$1", "pod", "(.*)-.*")`,
+		},
+		{
+			name: "label_join",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="envoy-1", series="2"} 6`,
+			query: `label_join(http_requests_total, "label", "/", "pod", "series")`,
+		},
+		{
+			name: "sort",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 5
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="1"} 3
+						http_requests_total{pod="nginx-4", series="2"} 8
+						http_requests_total{pod="nginx-5", series="2"} 1`,
+			query: `sort(http_requests_total)`,
+		},
+		{
+			name: "sort_desc",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 5
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="1"} 3
+						http_requests_total{pod="nginx-4", series="2"} 8
+						http_requests_total{pod="nginx-5", series="2"} 1`,
+			query: `sort_desc(http_requests_total)`,
+		},
+		{
+			name: "sort_desc of aggregation",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 5
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="2"} 1
+						http_requests_total{pod="nginx-4", series="3"} 8
+						http_requests_total{pod="nginx-5", series="3"} 1`,
+			query: `sort_desc(sum by (series) (http_requests_total))`,
+		},
+		{
+			name: "sort in parentheses",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 5
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="2"} 1`,
+			query: `(sort(http_requests_total))`,
+		},
+		{
+			name: "day_of_week",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1670000000
+						http_requests_total{pod="nginx-2"} 1680000000`,
+			query: `day_of_week(http_requests_total)`,
+		},
+		{
+			name:      "hour without arguments",
+			load:      ``,
+			queryTime: time.Unix(1670000000, 0),
+			query:     `hour()`,
+		},
+		{
+			name: "absent",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2`,
+			query: `absent(http_requests_total{pod="nginx-3", series=~"1"})`,
+		},
+		{
+			name: "absent_over_time",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2`,
+			query: `absent_over_time(http_requests_total{pod="nginx-1"}[1m])`,
+		},
+		{
+			name: "quantile_over_time",
 			load: `load 30s
-						http_requests_total{pod="nginx-1", series="1"} 1
-						http_requests_total{pod="nginx-2", series="1"} 2
-						http_requests_total{pod="nginx-3", series="1"} 8
-						http_requests_total{pod="nginx-4", series="2"} 6
-						http_requests_total{pod="nginx-5", series="2"} 8
-						http_requests_total{pod="nginx-6", series="3"} 15
-						http_requests_total{pod="nginx-7", series="3"} 11
-						http_requests_total{pod="nginx-8", series="4"} 22
-						http_requests_total{pod="nginx-9", series="4"} 89`,
-			query: "topk(2, http_requests_total)",
-			// TODO (alanprot): Top/BottomK series order on result. https://github.com/thanos-community/promql-engine/issues/120
-			sortByLabels: true,
+						http_requests_total{pod="nginx-1", series="1"} 1 5 3 7 2
+						http_requests_total{pod="nginx-2", series="1"} 2 4 6 8`,
+			queryTime: time.Unix(120, 0),
+			query:     `quantile_over_time(0.75, http_requests_total[2m])`,
 		},
 		{
-			name: "topk by series",
+			name: "predict_linear",
 			load: `load 30s
-						http_requests_total{pod="nginx-1", series="1"} 1
-						http_requests_total{pod="nginx-2", series="1"} 2
-						http_requests_total{pod="nginx-3", series="1"} 8
-						http_requests_total{pod="nginx-4", series="2"} 6
-						http_requests_total{pod="nginx-5", series="2"} 8
-						http_requests_total{pod="nginx-6", series="3"} 15
-						http_requests_total{pod="nginx-7", series="3"} 11
-						http_requests_total{pod="nginx-8", series="4"} 22
-						http_requests_total{pod="nginx-9", series="4"} 89`,
-			query:        "topk(2, http_requests_total) by (series)",
-			sortByLabels: true,
+						http_requests_total{pod="nginx-1", series="1"} 1 5 3 7 2
+						http_requests_total{pod="nginx-2", series="1"} 2 4 6 8`,
+			queryTime: time.Unix(120, 0),
+			query:     `predict_linear(http_requests_total[2m], 300)`,
 		},
 		{
-			name: "bottomK",
+			name: "holt_winters",
 			load: `load 30s
-						http_requests_total{pod="nginx-1", series="1"} 1
-						http_requests_total{pod="nginx-2", series="1"} 2
-						http_requests_total{pod="nginx-3", series="1"} 8
-						http_requests_total{pod="nginx-4", series="2"} 6
-						http_requests_total{pod="nginx-5", series="2"} 8
-						http_requests_total{pod="nginx-6", series="3"} 15
-						http_requests_total{pod="nginx-7", series="3"} 11
-						http_requests_total{pod="nginx-8", series="4"} 22
-						http_requests_total{pod="nginx-9", series="4"} 89`,
-			query:        "bottomk(2, http_requests_total)",
-			sortByLabels: true,
+						http_requests_total{pod="nginx-1", series="1"} 1 5 3 7 2
+						http_requests_total{pod="nginx-2", series="1"} 2 4 6 8`,
+			queryTime: time.Unix(120, 0),
+			query:     `holt_winters(http_requests_total[2m], 0.3, 0.6)`,
 		},
 		{
 			name: "bottomk by series",
@@ -2213,104 +3511,643 @@ func TestInstantQuery(t *testing.T) {
 		},
 	}
 
-	disableOptimizerOpts := []bool{true, false}
-	lookbackDeltas := []time.Duration{30 * time.Second, time.Minute, 5 * time.Minute, 10 * time.Minute}
-	for _, disableOptimizers := range disableOptimizerOpts {
-		t.Run(fmt.Sprintf("disableOptimizers=%t", disableOptimizers), func(t *testing.T) {
-			for _, lookbackDelta := range lookbackDeltas {
-				opts.LookbackDelta = lookbackDelta
-				for _, tc := range cases {
-					t.Run(tc.name, func(t *testing.T) {
-						test, err := promql.NewTest(t, tc.load)
-						testutil.Ok(t, err)
-						defer test.Close()
+	disableOptimizerOpts := []bool{true, false}
+	lookbackDeltas := []time.Duration{30 * time.Second, time.Minute, 5 * time.Minute, 10 * time.Minute}
+	for _, disableOptimizers := range disableOptimizerOpts {
+		t.Run(fmt.Sprintf("disableOptimizers=%t", disableOptimizers), func(t *testing.T) {
+			for _, lookbackDelta := range lookbackDeltas {
+				opts.LookbackDelta = lookbackDelta
+				for _, tc := range cases {
+					t.Run(tc.name, func(t *testing.T) {
+						test, err := promql.NewTest(t, tc.load)
+						testutil.Ok(t, err)
+						defer test.Close()
+
+						testutil.Ok(t, test.Run())
+
+						for _, disableFallback := range []bool{false, true} {
+							t.Run(fmt.Sprintf("disableFallback=%v", disableFallback), func(t *testing.T) {
+								var queryTime time.Time = defaultQueryTime
+								if tc.queryTime != (time.Time{}) {
+									queryTime = tc.queryTime
+								}
+
+								optimizers := logicalplan.AllOptimizers
+								if disableOptimizers {
+									optimizers = logicalplan.NoOptimizers
+								}
+								newEngine := engine.New(engine.Opts{
+									EngineOpts:        opts,
+									DisableFallback:   disableFallback,
+									LogicalOptimizers: optimizers,
+								})
+
+								q1, err := newEngine.NewInstantQuery(test.Storage(), nil, tc.query, queryTime)
+								testutil.Ok(t, err)
+								defer q1.Close()
+
+								newResult := q1.Exec(context.Background())
+								testutil.Ok(t, newResult.Err)
+
+								oldEngine := promql.NewEngine(opts)
+								q2, err := oldEngine.NewInstantQuery(test.Storage(), nil, tc.query, queryTime)
+								testutil.Ok(t, err)
+								defer q2.Close()
+
+								oldResult := q2.Exec(context.Background())
+								testutil.Ok(t, oldResult.Err)
+
+								if tc.sortByLabels {
+									sortByLabels(oldResult)
+									sortByLabels(newResult)
+								}
+
+								testutil.Equals(t, oldResult, newResult)
+							})
+						}
+					})
+				}
+			}
+		})
+	}
+}
+
+func TestQueryCancellation(t *testing.T) {
+	twelveHours := int64(12 * time.Hour.Seconds())
+
+	start := time.Unix(0, 0)
+	end := time.Unix(twelveHours, 0)
+	step := time.Second * 30
+	query := `sum(rate(http_requests_total{pod="nginx-1"}[10s]))`
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x1
+				http_requests_total{pod="nginx-2"} 1+2x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	testutil.Ok(t, test.Run())
+
+	querier := &storage.MockQueryable{
+		MockQuerier: &storage.MockQuerier{
+			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+				return newTestSeriesSet(&slowSeries{})
+			},
+		},
+	}
+
+	newEngine := engine.New(engine.Opts{})
+	q1, err := newEngine.NewRangeQuery(querier, nil, query, start, end, step)
+	testutil.Ok(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-time.After(1000 * time.Millisecond)
+		cancel()
+	}()
+
+	newResult := q1.Exec(ctx)
+	testutil.Equals(t, context.Canceled, newResult.Err)
+}
+
+func TestQueryStats(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18
+				http_requests_total{pod="nginx-3"} 1+2x5`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	opts := promql.EngineOpts{
+		Timeout:            1 * time.Hour,
+		MaxSamples:         1e10,
+		EnablePerStepStats: true,
+	}
+	queryOpts := &promql.QueryOpts{EnablePerStepStats: true}
+
+	cases := []struct {
+		name  string
+		query string
+		start time.Time
+		end   time.Time
+		step  time.Duration
+		// Prometheus evaluates the whole input of an aggregation before it is aggregated, and counts
+		// the input samples of each step again. Queries with aggregations therefore have a lower peak.
+		lowerPeakSamples bool
+	}{
+		{
+			name:  "vector selector",
+			query: `http_requests_total`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(300, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "rate",
+			query: `rate(http_requests_total[1m])`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(300, 0),
+			step:  45 * time.Second,
+		},
+		{
+			name:             "sum rate",
+			query:            `sum(rate(http_requests_total[1m]))`,
+			start:            time.Unix(0, 0),
+			end:              time.Unix(300, 0),
+			step:             45 * time.Second,
+			lowerPeakSamples: true,
+		},
+		{
+			name:  "instant query",
+			query: `sum_over_time(http_requests_total[2m])`,
+			start: time.Unix(200, 0),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				oldQuery promql.Query
+				newQuery promql.Query
+			)
+			// The peak number of samples depends on the order in which shards and
+			// workers hold their samples, so the query is executed sequentially.
+			newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, MaxQueryParallelism: 1})
+			oldEngine := promql.NewEngine(opts)
+			if tc.step == 0 {
+				newQuery, err = newEngine.NewInstantQuery(test.Storage(), queryOpts, tc.query, tc.start)
+				testutil.Ok(t, err)
+				oldQuery, err = oldEngine.NewInstantQuery(test.Storage(), queryOpts, tc.query, tc.start)
+				testutil.Ok(t, err)
+			} else {
+				newQuery, err = newEngine.NewRangeQuery(test.Storage(), queryOpts, tc.query, tc.start, tc.end, tc.step)
+				testutil.Ok(t, err)
+				oldQuery, err = oldEngine.NewRangeQuery(test.Storage(), queryOpts, tc.query, tc.start, tc.end, tc.step)
+				testutil.Ok(t, err)
+			}
+			defer newQuery.Close()
+			defer oldQuery.Close()
+
+			testutil.Ok(t, newQuery.Exec(context.Background()).Err)
+			testutil.Ok(t, oldQuery.Exec(context.Background()).Err)
+
+			newStats := newQuery.Stats()
+			oldStats := oldQuery.Stats()
+			testutil.Equals(t, oldStats.Samples.TotalSamples, newStats.Samples.TotalSamples)
+			testutil.Equals(t, oldStats.Samples.TotalSamplesPerStep, newStats.Samples.TotalSamplesPerStep)
+			if tc.lowerPeakSamples {
+				testutil.Assert(t, newStats.Samples.PeakSamples > 0, "expected peak samples to be set")
+				testutil.Assert(t, newStats.Samples.PeakSamples < oldStats.Samples.PeakSamples, "expected peak samples to be lower than %d, got %d", oldStats.Samples.PeakSamples, newStats.Samples.PeakSamples)
+			} else {
+				testutil.Equals(t, oldStats.Samples.PeakSamples, newStats.Samples.PeakSamples)
+			}
+
+			timings := stats.NewQueryStats(newStats).Builtin().Timings
+			testutil.Assert(t, timings.ExecTotalTime > 0, "expected total execution time to be set")
+			testutil.Assert(t, timings.QueryPreparationTime > 0, "expected preparation time to be set")
+			testutil.Assert(t, timings.InnerEvalTime > 0, "expected evaluation time to be set")
+		})
+	}
+}
+
+func TestMaxSamples(t *testing.T) {
+	load := `load 10s
+				http_requests_total{pod="nginx-1"} 1+1x60
+				http_requests_total{pod="nginx-2"} 1+2x60
+				http_requests_total{pod="nginx-3"} 1+3x60`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	cases := []struct {
+		name       string
+		query      string
+		start      time.Time
+		end        time.Time
+		step       time.Duration
+		maxSamples int
+		expectErr  bool
+	}{
+		{
+			name:       "vector selector within limit",
+			query:      `http_requests_total`,
+			start:      time.Unix(0, 0),
+			end:        time.Unix(300, 0),
+			step:       30 * time.Second,
+			maxSamples: 100,
+		},
+		{
+			name:       "vector selector exceeding limit",
+			query:      `http_requests_total`,
+			start:      time.Unix(0, 0),
+			end:        time.Unix(300, 0),
+			step:       30 * time.Second,
+			maxSamples: 20,
+			expectErr:  true,
+		},
+		{
+			name:       "range exceeding limit",
+			query:      `sum(rate(http_requests_total[5m]))`,
+			start:      time.Unix(400, 0),
+			maxSamples: 20,
+			expectErr:  true,
+		},
+		{
+			name:       "range within limit",
+			query:      `sum(rate(http_requests_total[5m]))`,
+			start:      time.Unix(400, 0),
+			maxSamples: 100,
+		},
+		{
+			name:       "binary operation within limit",
+			query:      `sum by (pod) (http_requests_total) / on (pod) http_requests_total`,
+			start:      time.Unix(0, 0),
+			end:        time.Unix(300, 0),
+			step:       30 * time.Second,
+			maxSamples: 200,
+		},
+		{
+			name:       "subquery exceeding limit",
+			query:      `max_over_time(http_requests_total[5m:10s])`,
+			start:      time.Unix(400, 0),
+			maxSamples: 50,
+			expectErr:  true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := promql.EngineOpts{
+				Timeout:    1 * time.Hour,
+				MaxSamples: tc.maxSamples,
+			}
+			for _, e := range []v1.QueryEngine{
+				promql.NewEngine(opts),
+				engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true}),
+			} {
+				var q promql.Query
+				if tc.step == 0 {
+					q, err = e.NewInstantQuery(test.Storage(), nil, tc.query, tc.start)
+				} else {
+					q, err = e.NewRangeQuery(test.Storage(), nil, tc.query, tc.start, tc.end, tc.step)
+				}
+				testutil.Ok(t, err)
+
+				res := q.Exec(context.Background())
+				q.Close()
+				if tc.expectErr {
+					testutil.Equals(t, promql.ErrTooManySamples("query execution"), res.Err)
+				} else {
+					testutil.Ok(t, res.Err)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x40
+				http_requests_total{pod="nginx-3"} 1+3x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	var (
+		qry   = `sum by (pod) (rate(http_requests_total[5m])) / on (pod) max_over_time(http_requests_total[5m:1m])`
+		start = time.Unix(0, 0)
+		end   = time.Unix(1200, 0)
+		step  = 30 * time.Second
+	)
+	exec := func(limit int64) (*promql.Result, int64) {
+		newEngine := engine.New(engine.Opts{MemoryLimitBytes: limit, DisableFallback: true})
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, qry, start, end, step)
+		testutil.Ok(t, err)
+		defer q.Close()
+
+		res := q.Exec(context.Background())
+		peak := q.(engine.MemoryStatsQuery).PeakMemoryBytes()
+		testutil.Equals(t, peak, q.(engine.MemoryStatsQuery).QueryStats().(*engine.QueryStats).PeakMemoryBytes)
+		return res, peak
+	}
+
+	res, peak := exec(0)
+	testutil.Ok(t, res.Err)
+	testutil.Assert(t, peak > 0, "expected peak memory to be tracked")
+
+	res, _ = exec(10 * peak)
+	testutil.Ok(t, res.Err)
+
+	res, _ = exec(peak / 2)
+	testutil.Assert(t, errors.Is(res.Err, query.ErrMemoryLimitExceeded), "expected memory limit error, got %v", res.Err)
+	testutil.Equals(t, nil, res.Value)
+}
+
+func TestQueryParallelism(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18
+				http_requests_total{pod="nginx-3"} 1+3x18
+				http_requests_total{pod="nginx-4"} 1+4x18`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	var (
+		query = `sum by (pod) (rate(http_requests_total[1m])) / on (pod) -http_requests_total`
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		step  = 30 * time.Second
+	)
+	oldQuery, err := promql.NewEngine(promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10}).NewRangeQuery(test.Storage(), nil, query, start, end, step)
+	testutil.Ok(t, err)
+	defer oldQuery.Close()
+	expected := oldQuery.Exec(context.Background())
+	testutil.Ok(t, expected.Err)
+
+	cases := []struct {
+		name                string
+		maxQueryParallelism int
+		workerBudget        int
+		expectedShards      int
+	}{
+		{name: "no parallelism", maxQueryParallelism: 1, expectedShards: 1},
+		{name: "parallelism", maxQueryParallelism: 3, expectedShards: 3},
+		{name: "parallelism limited by budget", maxQueryParallelism: 4, workerBudget: 2, expectedShards: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{
+				DisableFallback:     true,
+				MaxQueryParallelism: tc.maxQueryParallelism,
+				WorkerBudget:        tc.workerBudget,
+			})
+
+			queries := make([]promql.Query, 4)
+			for i := range queries {
+				queries[i], err = newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+				testutil.Ok(t, err)
+				defer queries[i].Close()
+			}
+
+			// Queries are executed concurrently so that they compete for the worker budget.
+			var wg sync.WaitGroup
+			results := make([]*promql.Result, len(queries))
+			for i := range queries {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					results[i] = queries[i].Exec(context.Background())
+				}(i)
+			}
+			wg.Wait()
+
+			for i, q := range queries {
+				testutil.Ok(t, results[i].Err)
+				testutil.Equals(t, expected, results[i])
+
+				var coalesceChildren []int
+				var walk func(node engine.ExplainOutputNode)
+				walk = func(node engine.ExplainOutputNode) {
+					if node.OperatorName == "[*coalesceOperator]" {
+						coalesceChildren = append(coalesceChildren, len(node.Children))
+					}
+					for _, c := range node.Children {
+						walk(c)
+					}
+				}
+				walk(*q.(engine.ExplainableQuery).Explain())
+				testutil.Equals(t, []int{tc.expectedShards, tc.expectedShards}, coalesceChildren)
+			}
+		})
+	}
+}
+
+func TestQueryParallelismLimitsGoroutines(t *testing.T) {
+	var (
+		query = `sum by (pod) (rate(http_requests_total[1m])) / on (pod) -http_requests_total`
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		step  = 30 * time.Second
+	)
+	peakGoroutines := func(parallelism int) int64 {
+		var peak atomic.Int64
+		series := make([]storage.Series, 0, 8)
+		for i := 0; i < cap(series); i++ {
+			timestamps := make([]int64, 0, 20)
+			values := make([]float64, 0, 20)
+			for ts := int64(0); ts <= end.UnixMilli(); ts += step.Milliseconds() {
+				timestamps = append(timestamps, ts)
+				values = append(values, float64(ts))
+			}
+			series = append(series, goroutineCountingSeries{
+				Series: newMockSeries([]string{labels.MetricName, "http_requests_total", "pod", fmt.Sprintf("nginx-%d", i)}, timestamps, values),
+				peak:   &peak,
+			})
+		}
 
-						testutil.Ok(t, test.Run())
+		newEngine := engine.New(engine.Opts{DisableFallback: true, MaxQueryParallelism: parallelism})
+		q, err := newEngine.NewRangeQuery(storageWithSeries(series...), nil, query, start, end, step)
+		testutil.Ok(t, err)
+		defer q.Close()
 
-						for _, disableFallback := range []bool{false, true} {
-							t.Run(fmt.Sprintf("disableFallback=%v", disableFallback), func(t *testing.T) {
-								var queryTime time.Time = defaultQueryTime
-								if tc.queryTime != (time.Time{}) {
-									queryTime = tc.queryTime
-								}
+		// Goroutines of previous queries stop asynchronously once the queries are closed.
+		for i := 0; countEngineGoroutines() > 0; i++ {
+			testutil.Assert(t, i < 100, "expected goroutines of previous queries to stop")
+			time.Sleep(10 * time.Millisecond)
+		}
+		testutil.Ok(t, q.Exec(context.Background()).Err)
+		return peak.Load()
+	}
 
-								optimizers := logicalplan.AllOptimizers
-								if disableOptimizers {
-									optimizers = logicalplan.NoOptimizers
-								}
-								newEngine := engine.New(engine.Opts{
-									EngineOpts:        opts,
-									DisableFallback:   disableFallback,
-									LogicalOptimizers: optimizers,
-								})
+	// Without parallelism, the query is executed by its own goroutine, the two goroutines of each
+	// concurrency operator, which prefetch batches of the two selectors and the aggregation,
+	// and a single worker of the aggregation and of the negation.
+	sequential := peakGoroutines(1)
+	testutil.Assert(t, sequential <= 9, "expected at most 9 goroutines without parallelism, got %d", sequential)
 
-								q1, err := newEngine.NewInstantQuery(test.Storage(), nil, tc.query, queryTime)
-								testutil.Ok(t, err)
-								defer q1.Close()
+	parallel := peakGoroutines(4)
+	testutil.Assert(t, parallel > sequential, "expected more goroutines with parallelism, got %d and %d without parallelism", parallel, sequential)
+}
 
-								newResult := q1.Exec(context.Background())
-								testutil.Ok(t, newResult.Err)
+func TestQueryAnalyze(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`
 
-								oldEngine := promql.NewEngine(opts)
-								q2, err := oldEngine.NewInstantQuery(test.Storage(), nil, tc.query, queryTime)
-								testutil.Ok(t, err)
-								defer q2.Close()
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-								oldResult := q2.Exec(context.Background())
-								testutil.Ok(t, oldResult.Err)
+	var (
+		query = `sum(rate(http_requests_total[1m]))`
+		start = time.Unix(0, 0)
+		end   = time.Unix(300, 0)
+		step  = 30 * time.Second
+	)
+	for _, enableAnalysis := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enableAnalysis=%t", enableAnalysis), func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{EnableAnalysis: enableAnalysis, DisableFallback: true})
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q.Close()
 
-								if tc.sortByLabels {
-									sortByLabels(oldResult)
-									sortByLabels(newResult)
-								}
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
 
-								testutil.Equals(t, oldResult, newResult)
-							})
-						}
-					})
+			explainable, ok := q.(engine.ExplainableQuery)
+			testutil.Assert(t, ok, "expected query to be explainable")
+
+			explain := explainable.Explain()
+			testutil.Assert(t, strings.HasPrefix(explain.OperatorName, "[*concurrencyOperator"), "unexpected root operator %s", explain.OperatorName)
+			testutil.Equals(t, 1, len(explain.Children))
+			testutil.Assert(t, strings.HasPrefix(explain.Children[0].OperatorName, "[*aggregate]"), "unexpected operator %s", explain.Children[0].OperatorName)
+
+			analyze := explainable.Analyze()
+			if !enableAnalysis {
+				testutil.Assert(t, analyze == nil, "expected no analysis")
+				return
+			}
+			testutil.Equals(t, explain.OperatorName, analyze.OperatorName)
+			testutil.Equals(t, int64(1), analyze.Series)
+			testutil.Equals(t, int64(len(result.Value.(promql.Matrix)[0].Points)), analyze.Samples)
+			testutil.Assert(t, analyze.NextCalls > 0, "expected next to be called")
+			testutil.Assert(t, analyze.WallTime > 0, "expected wall time to be recorded")
+
+			var selectorSamples int64
+			var cpuTime time.Duration
+			var walk func(node engine.AnalyzeOutputNode)
+			walk = func(node engine.AnalyzeOutputNode) {
+				if strings.HasPrefix(node.OperatorName, "[*matrixSelector]") {
+					selectorSamples += node.Samples
 				}
+				cpuTime += node.CPUTime
+				for _, c := range node.Children {
+					walk(c)
+				}
+			}
+			walk(*analyze)
+			// Both series have a rate in each step except for the first one.
+			testutil.Equals(t, int64(20), selectorSamples)
+			if runtime.GOOS == "linux" {
+				testutil.Assert(t, cpuTime > 0, "expected cpu time to be recorded")
 			}
 		})
 	}
 }
 
-func TestQueryCancellation(t *testing.T) {
-	twelveHours := int64(12 * time.Hour.Seconds())
-
-	start := time.Unix(0, 0)
-	end := time.Unix(twelveHours, 0)
-	step := time.Second * 30
-	query := `sum(rate(http_requests_total{pod="nginx-1"}[10s]))`
+func TestQueryTracing(t *testing.T) {
 	load := `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x1
-				http_requests_total{pod="nginx-2"} 1+2x40`
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`
 
 	test, err := promql.NewTest(t, load)
 	testutil.Ok(t, err)
 	defer test.Close()
-
 	testutil.Ok(t, test.Run())
 
-	querier := &storage.MockQueryable{
-		MockQuerier: &storage.MockQuerier{
-			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
-				return newTestSeriesSet(&slowSeries{})
-			},
-		},
+	var (
+		query = `sum(rate(http_requests_total[1m]))`
+		start = time.Unix(0, 0)
+		end   = time.Unix(300, 0)
+		step  = 30 * time.Second
+	)
+	for _, enableTracing := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enableTracing=%t", enableTracing), func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			ctx, rootSpan := provider.Tracer("test").Start(context.Background(), "query")
+
+			newEngine := engine.New(engine.Opts{EnableTracing: enableTracing, DisableFallback: true})
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q.Close()
+			testutil.Ok(t, q.Exec(ctx).Err)
+			rootSpan.End()
+
+			// All spans have to be finished once the query was executed.
+			testutil.Equals(t, len(recorder.Started()), len(recorder.Ended()))
+			if !enableTracing {
+				testutil.Equals(t, 1, len(recorder.Ended()))
+				return
+			}
+
+			spans := make(map[trace.SpanID]sdktrace.ReadOnlySpan)
+			var selectorSpan sdktrace.ReadOnlySpan
+			for _, span := range recorder.Ended() {
+				testutil.Equals(t, rootSpan.SpanContext().TraceID(), span.SpanContext().TraceID())
+				spans[span.SpanContext().SpanID()] = span
+				if span.Name() == "matrixSelector" {
+					selectorSpan = span
+				}
+			}
+			testutil.Assert(t, selectorSpan != nil, "expected span for matrix selector")
+
+			// Operator spans are nested in the same way as the operators.
+			var path []string
+			for span := selectorSpan; span != nil; span = spans[span.Parent().SpanID()] {
+				path = append(path, span.Name())
+			}
+			testutil.Equals(t, []string{"matrixSelector", "concurrencyOperator", "coalesceOperator", "aggregate", "concurrencyOperator", "query"}, path)
+
+			var selectorSeriesSpans int
+			for _, span := range spans {
+				if span.Name() == "Series" && span.Parent().SpanID() == selectorSpan.SpanContext().SpanID() {
+					selectorSeriesSpans++
+				}
+			}
+			testutil.Equals(t, 1, selectorSeriesSpans)
+
+			rootOperator := spans[selectorSpan.Parent().SpanID()]
+			for rootOperator.Parent().SpanID() != rootSpan.SpanContext().SpanID() {
+				rootOperator = spans[rootOperator.Parent().SpanID()]
+			}
+			var samples int64
+			for _, attr := range rootOperator.Attributes() {
+				if attr.Key == "samples" {
+					samples = attr.Value.AsInt64()
+				}
+			}
+			testutil.Equals(t, int64(10), samples)
+		})
 	}
+}
 
+func TestExplainLogicalPlan(t *testing.T) {
 	newEngine := engine.New(engine.Opts{})
-	q1, err := newEngine.NewRangeQuery(querier, nil, query, start, end, step)
+	passes, err := newEngine.ExplainLogicalPlan(`sum(http_requests_total{pod="nginx-1"}) / sum(http_requests_total)`, time.Unix(0, 0), time.Unix(300, 0))
 	testutil.Ok(t, err)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		<-time.After(1000 * time.Millisecond)
-		cancel()
-	}()
+	testutil.Equals(t, len(logicalplan.DefaultOptimizers)+1, len(passes))
+	testutil.Equals(t, "", passes[0].Optimizer)
+	testutil.Equals(t, `/
+├── sum
+│   └── http_requests_total{pod="nginx-1"}
+└── sum
+    └── http_requests_total
+`, passes[0].Plan)
 
-	newResult := q1.Exec(ctx)
-	testutil.Equals(t, context.Canceled, newResult.Err)
+	last := passes[len(passes)-1]
+	testutil.Equals(t, "MergeSelectsOptimizer", last.Optimizer)
+	testutil.Equals(t, `/
+├── sum
+│   └── filter([pod="nginx-1"], http_requests_total)
+└── sum
+    └── http_requests_total
+`, last.Plan)
+
+	_, err = newEngine.ExplainLogicalPlan(`sum(`, time.Unix(0, 0), time.Unix(300, 0))
+	testutil.NotOk(t, err)
 }
 
 type hintRecordingQuerier struct {
@@ -2659,8 +4496,8 @@ func TestFallback(t *testing.T) {
 	end := time.Unix(120, 0)
 	step := time.Second * 30
 
-	// TODO(fpetkovski): Update this expression once we add support for sort_desc.
-	query := `sort_desc(http_requests_total{pod="nginx-1"})`
+	// holt_winters is only supported with literal smoothing and trend factors.
+	query := `holt_winters(http_requests_total{pod="nginx-1"}[1m], scalar(http_requests_total{pod="nginx-2"}) / 100, 0.5)`
 	load := `load 30s
 				http_requests_total{pod="nginx-1"} 1+1x1
 				http_requests_total{pod="nginx-2"} 1+2x40`
@@ -2712,6 +4549,172 @@ func storageWithSeries(series ...storage.Series) *storage.MockQueryable {
 	}
 }
 
+// storageWithMatchingSeries returns a queryable which selects the series matching all matchers.
+func storageWithMatchingSeries(series ...storage.Series) *storage.MockQueryable {
+	return &storage.MockQueryable{
+		MockQuerier: &storage.MockQuerier{
+			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+				result := make([]storage.Series, 0)
+			loopSeries:
+				for _, s := range series {
+					for _, m := range matchers {
+						if !m.Matches(s.Labels().Get(m.Name)) {
+							continue loopSeries
+						}
+					}
+					result = append(result, s)
+				}
+				return newTestSeriesSet(result...)
+			},
+		},
+	}
+}
+
+func TestQueryLogger(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	var (
+		start = time.Unix(0, 0)
+		end   = time.Unix(120, 0)
+		step  = 30 * time.Second
+	)
+	logger := &testQueryLogger{}
+	newEngine := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour, MaxSamples: math.MaxInt64}})
+	newEngine.SetQueryLogger(logger)
+
+	cases := []struct {
+		name     string
+		query    string
+		fallback bool
+	}{
+		{name: "native query", query: `sum(rate(http_requests_total[1m]))`},
+		// holt_winters is only supported with literal smoothing and trend factors.
+		{name: "fallback query", query: `holt_winters(http_requests_total[1m], scalar(http_requests_total{pod="nginx-2"}) / 100, 0.5)`, fallback: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger.entries = nil
+
+			ctx := context.WithValue(context.Background(), promql.QueryOrigin{}, map[string]interface{}{"origin": "test"})
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			defer q.Close()
+			testutil.Ok(t, q.Exec(ctx).Err)
+
+			testutil.Equals(t, 1, len(logger.entries))
+			entry := logger.entries[0]
+			testutil.Equals(t, map[string]interface{}{
+				"query": q.String(),
+				"start": "1970-01-01T00:00:00.000Z",
+				"end":   "1970-01-01T00:02:00.000Z",
+				"step":  int64(30),
+			}, entry["params"])
+			testutil.Equals(t, "test", entry["origin"])
+			testutil.Equals(t, tc.fallback, entry["fallback"])
+			_, ok := entry["stats"]
+			testutil.Assert(t, ok, "expected query stats to be logged")
+			if !tc.fallback {
+				testutil.Equals(t, q.(engine.MemoryStatsQuery).QueryStats(), entry["stats"])
+				testutil.Assert(t, entry["stats"].(*engine.QueryStats).PeakMemoryBytes > 0, "expected peak memory to be logged")
+			}
+			_, ok = entry["error"]
+			testutil.Assert(t, !ok, "expected no error to be logged")
+		})
+	}
+
+	newEngine.SetQueryLogger(nil)
+	testutil.Assert(t, logger.closed, "expected query logger to be closed")
+}
+
+func TestEngineMetrics(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	reg := prometheus.NewRegistry()
+	newEngine := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Reg: reg, Timeout: time.Hour, MaxSamples: math.MaxInt64}})
+
+	instantQuery, err := newEngine.NewInstantQuery(test.Storage(), nil, `http_requests_total`, time.Unix(60, 0))
+	testutil.Ok(t, err)
+	defer instantQuery.Close()
+	testutil.Ok(t, instantQuery.Exec(context.Background()).Err)
+
+	rangeQuery, err := newEngine.NewRangeQuery(test.Storage(), nil, `http_requests_total{pod="nginx-1"}`, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer rangeQuery.Close()
+	testutil.Ok(t, rangeQuery.Exec(context.Background()).Err)
+
+	// holt_winters is only supported with literal smoothing and trend factors.
+	fallbackQuery, err := newEngine.NewInstantQuery(test.Storage(), nil, `holt_winters(http_requests_total[1m], scalar(http_requests_total{pod="nginx-2"}) / 100, 0.5)`, time.Unix(60, 0))
+	testutil.Ok(t, err)
+	defer fallbackQuery.Close()
+	testutil.Ok(t, fallbackQuery.Exec(context.Background()).Err)
+
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP promql_engine_fallbacks_total Number of PromQL queries which fell back to the Prometheus engine, by the unsupported function or expression.
+# TYPE promql_engine_fallbacks_total counter
+promql_engine_fallbacks_total{reason="holt_winters"} 1
+# HELP promql_engine_queries_total Number of PromQL queries.
+# TYPE promql_engine_queries_total counter
+promql_engine_queries_total{fallback="false"} 2
+promql_engine_queries_total{fallback="true"} 1
+# HELP promql_engine_samples_total Number of samples selected by PromQL queries executed by the engine.
+# TYPE promql_engine_samples_total counter
+promql_engine_samples_total 7
+# HELP promql_engine_series_total Number of series loaded by PromQL queries executed by the engine.
+# TYPE promql_engine_series_total counter
+promql_engine_series_total 3
+`), "promql_engine_fallbacks_total", "promql_engine_queries_total", "promql_engine_samples_total", "promql_engine_series_total"))
+
+	families, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, queryType := range []string{"instant", "range"} {
+		var count uint64
+		for _, mf := range families {
+			if mf.GetName() != "promql_engine_query_duration_seconds" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				if m.GetLabel()[0].GetValue() == queryType {
+					count = m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+		testutil.Equals(t, uint64(1), count)
+	}
+}
+
+type testQueryLogger struct {
+	entries []map[string]interface{}
+	closed  bool
+}
+
+func (l *testQueryLogger) Log(args ...interface{}) error {
+	entry := make(map[string]interface{}, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		entry[args[i].(string)] = args[i+1]
+	}
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+func (l *testQueryLogger) Close() error {
+	l.closed = true
+	return nil
+}
+
 type mockSeries struct {
 	labels     []string
 	timestamps []int64
@@ -2791,6 +4794,125 @@ func (s *testSeriesSet) At() storage.Series         { return s.series[s.i] }
 func (s *testSeriesSet) Err() error                 { return nil }
 func (s *testSeriesSet) Warnings() storage.Warnings { return nil }
 
+func TestQueryTimeout(t *testing.T) {
+	querier := &storage.MockQueryable{
+		MockQuerier: &storage.MockQuerier{
+			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+				return newTestSeriesSet(&slowSeries{})
+			},
+		},
+	}
+
+	newEngine := engine.New(engine.Opts{
+		EngineOpts:      promql.EngineOpts{Timeout: 100 * time.Millisecond},
+		DisableFallback: true,
+	})
+	q, err := newEngine.NewRangeQuery(querier, nil, `sum(rate(http_requests_total[10s]))`, time.Unix(0, 0), time.Unix(12*3600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	result := q.Exec(context.Background())
+	testutil.Equals(t, promql.ErrQueryTimeout("query execution"), result.Err)
+}
+
+func TestActiveQueryTracker(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	tracker := newTestQueryTracker(1)
+	newEngine := engine.New(engine.Opts{
+		EngineOpts:      promql.EngineOpts{ActiveQueryTracker: tracker},
+		DisableFallback: true,
+	})
+
+	query := `sum(rate(http_requests_total[1m]))`
+	q, err := newEngine.NewInstantQuery(test.Storage(), nil, query, time.Unix(300, 0))
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	// Queries have to wait for a free slot while the tracker is at its limit.
+	idx, err := tracker.Insert(context.Background(), "blocking query")
+	testutil.Ok(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result := q.Exec(ctx)
+	testutil.Equals(t, promql.ErrQueryTimeout("query queue"), result.Err)
+	tracker.Delete(idx)
+
+	result = q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+	testutil.Equals(t, []string{"blocking query", query}, tracker.inserted)
+	testutil.Equals(t, 0, len(tracker.slots))
+}
+
+type testQueryTracker struct {
+	slots    chan struct{}
+	inserted []string
+}
+
+func newTestQueryTracker(maxConcurrent int) *testQueryTracker {
+	return &testQueryTracker{slots: make(chan struct{}, maxConcurrent)}
+}
+
+func (t *testQueryTracker) GetMaxConcurrent() int { return cap(t.slots) }
+
+func (t *testQueryTracker) Insert(ctx context.Context, query string) (int, error) {
+	select {
+	case t.slots <- struct{}{}:
+		t.inserted = append(t.inserted, query)
+		return len(t.inserted) - 1, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (t *testQueryTracker) Delete(int) { <-t.slots }
+
+// goroutineCountingSeries records the highest number of goroutines of the engine which run while its samples are read.
+type goroutineCountingSeries struct {
+	storage.Series
+	peak *atomic.Int64
+}
+
+func (s goroutineCountingSeries) Iterator() chunkenc.Iterator {
+	return goroutineCountingIterator{Iterator: s.Series.Iterator(), peak: s.peak}
+}
+
+type goroutineCountingIterator struct {
+	chunkenc.Iterator
+	peak *atomic.Int64
+}
+
+func (it goroutineCountingIterator) Next() chunkenc.ValueType {
+	n := countEngineGoroutines()
+	for peak := it.peak.Load(); n > peak; peak = it.peak.Load() {
+		if it.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	return it.Iterator.Next()
+}
+
+// countEngineGoroutines returns the number of goroutines which execute operators of the engine.
+func countEngineGoroutines() int64 {
+	stacks := make([]byte, 1<<20)
+	stacks = stacks[:runtime.Stack(stacks, true)]
+
+	var n int64
+	for _, stack := range strings.Split(string(stacks), "\n\n") {
+		if strings.Contains(stack, "promql-engine/execution") || strings.Contains(stack, "promql-engine/worker") {
+			n++
+		}
+	}
+	return n
+}
+
 type slowSeries struct{}
 
 func (d slowSeries) Labels() labels.Labels       { return labels.FromStrings("foo", "bar") }
@@ -2914,3 +5036,47 @@ func roundValues(r *promql.Result) {
 		}
 	}
 }
+
+func TestPeakMemoryOfReleasedBuffers(t *testing.T) {
+	// Each series only has samples in its own hour.
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x120
+				http_requests_total{pod="nginx-2"} _x120 1+1x120
+				http_requests_total{pod="nginx-3"} _x240 1+1x120
+				http_requests_total{pod="nginx-4"} _x360 1+1x120
+				http_requests_total{pod="nginx-5"} _x480 1+1x120
+				http_requests_total{pod="nginx-6"} _x600 1+1x120
+				http_requests_total{pod="nginx-7"} _x720 1+1x120
+				http_requests_total{pod="nginx-8"} _x840 1+1x120
+				http_requests_total{pod="nginx-9"} _x960 1+1x120
+				http_requests_total{pod="nginx-10"} _x1080 1+1x120`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	exec := func(qry string) int64 {
+		newEngine := engine.New(engine.Opts{DisableFallback: true})
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, qry, time.Unix(0, 0), time.Unix(36000, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer q.Close()
+
+		res := q.Exec(context.Background())
+		testutil.Ok(t, res.Err)
+		return q.(engine.MemoryStatsQuery).PeakMemoryBytes()
+	}
+
+	for _, qry := range []string{
+		`max_over_time(http_requests_total[1h])`,
+		`max_over_time(http_requests_total[1h:30s])`,
+	} {
+		t.Run(qry, func(t *testing.T) {
+			// Buffers of series are released once their samples fall out of the range,
+			// so at most two series are buffered at the same time.
+			single := exec(strings.Replace(qry, "http_requests_total", `http_requests_total{pod="nginx-1"}`, 1))
+			all := exec(qry)
+			testutil.Assert(t, all < 3*single, "expected peak memory of %d to be close to the one of a single series, got %d", single, all)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/telemetry"
+	"github.com/thanos-community/promql-engine/logicalplan"
+)
+
+// ExplainableQuery is implemented by queries which are executed by this engine.
+// Queries which fall back to the Prometheus engine do not implement it.
+type ExplainableQuery interface {
+	promql.Query
+
+	// Explain returns the physical plan of the query.
+	Explain() *ExplainOutputNode
+	// Analyze returns the physical plan of the query together with the execution
+	// statistics of each operator. It returns nil if analysis is not enabled.
+	Analyze() *AnalyzeOutputNode
+}
+
+// LogicalPlanExplainer is implemented by engines which can show how
+// their logical optimizers change the plan of a query.
+type LogicalPlanExplainer interface {
+	// ExplainLogicalPlan returns the logical plan of the query before optimization
+	// and after each logical optimizer.
+	ExplainLogicalPlan(qs string, start, end time.Time) ([]logicalplan.OptimizerPass, error)
+}
+
+// ExplainOutputNode is an operator in the physical plan of a query.
+type ExplainOutputNode struct {
+	OperatorName string              `json:"name"`
+	Children     []ExplainOutputNode `json:"children,omitempty"`
+}
+
+// AnalyzeOutputNode is an operator in the physical plan of an executed query.
+type AnalyzeOutputNode struct {
+	OperatorName string `json:"name"`
+	// WallTime is the time spent in the operator, including the time spent in its inputs.
+	WallTime time.Duration `json:"wallTime"`
+	// CPUTime is the CPU time spent in the operator, including the time spent in inputs which are
+	// evaluated by the same goroutine. Inputs of exchange operators, which are evaluated concurrently,
+	// account for their own CPU time. It is only measured on Linux, and is zero on other systems.
+	CPUTime   time.Duration       `json:"cpuTime"`
+	NextCalls int64               `json:"nextCalls"`
+	Series    int64               `json:"series"`
+	Samples   int64               `json:"samples"`
+	Children  []AnalyzeOutputNode `json:"children,omitempty"`
+}
+
+func explainOperator(o model.VectorOperator) ExplainOutputNode {
+	me, next := o.Explain()
+	node := ExplainOutputNode{OperatorName: me}
+	for _, n := range next {
+		node.Children = append(node.Children, explainOperator(n))
+	}
+	return node
+}
+
+func analyzeOperator(o model.VectorOperator) AnalyzeOutputNode {
+	me, next := o.Explain()
+	node := AnalyzeOutputNode{OperatorName: me}
+	if t, ok := o.(*telemetry.Operator); ok {
+		stats := t.Stats()
+		node.WallTime = stats.WallTime
+		node.CPUTime = stats.CPUTime
+		node.NextCalls = stats.NextCalls
+		node.Series = stats.Series
+		node.Samples = stats.Samples
+	}
+
+	for _, n := range next {
+		node.Children = append(node.Children, analyzeOperator(n))
+	}
+	return node
+}
+
+// finishSpans finishes the tracing spans of all operators in the plan which were
+// not exhausted while the query was executed.
+func finishSpans(o model.VectorOperator) {
+	if t, ok := o.(*telemetry.Operator); ok {
+		t.Finish()
+	}
+	_, next := o.Explain()
+	for _, n := range next {
+		finishSpans(n)
+	}
+}
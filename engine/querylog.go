@@ -0,0 +1,78 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/prometheus/promql"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SetQueryLogger sets the logger for queries executed by the engine. Queries which
+// fall back to the Prometheus engine are logged with the same logger, and both kinds
+// of queries have a "fallback" field which tells which engine executed the query.
+func (e *compatibilityEngine) SetQueryLogger(l promql.QueryLogger) {
+	e.queryLoggerLock.Lock()
+	defer e.queryLoggerLock.Unlock()
+
+	e.queryLogger = l
+	// The Prometheus engine closes the previous logger, so it must not be closed here.
+	if l == nil {
+		e.prom.SetQueryLogger(nil)
+		return
+	}
+	e.prom.SetQueryLogger(fallbackQueryLogger{QueryLogger: l})
+}
+
+// logQuery logs the query with the same fields as the Prometheus engine.
+func (q *compatibilityQuery) logQuery(ctx context.Context, err error) {
+	q.engine.queryLoggerLock.RLock()
+	defer q.engine.queryLoggerLock.RUnlock()
+
+	l := q.engine.queryLogger
+	if l == nil {
+		return
+	}
+
+	params := map[string]interface{}{
+		"query": q.String(),
+		"start": formatDate(q.start),
+		"end":   formatDate(q.end),
+		// The step provided by the user is in seconds.
+		"step": int64(q.step / time.Second),
+	}
+	f := []interface{}{"params", params}
+	if err != nil {
+		f = append(f, "error", err)
+	}
+	f = append(f, "stats", q.QueryStats())
+	if span := trace.SpanFromContext(ctx); span != nil {
+		f = append(f, "spanID", span.SpanContext().SpanID())
+	}
+	if origin := ctx.Value(promql.QueryOrigin{}); origin != nil {
+		for k, v := range origin.(map[string]interface{}) {
+			f = append(f, k, v)
+		}
+	}
+	f = append(f, "fallback", false)
+	if err := l.Log(f...); err != nil {
+		level.Error(q.engine.logger).Log("msg", "can't log query", "err", err)
+	}
+}
+
+// fallbackQueryLogger marks queries which are logged by the Prometheus engine as fallback queries.
+type fallbackQueryLogger struct {
+	promql.QueryLogger
+}
+
+func (l fallbackQueryLogger) Log(args ...interface{}) error {
+	return l.QueryLogger.Log(append(args, "fallback", true)...)
+}
+
+func formatDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
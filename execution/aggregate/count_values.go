@@ -0,0 +1,243 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"unsafe"
+
+	"github.com/efficientgo/core/errors"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/exp/slices"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+const (
+	sizeOfFloat64 = int(unsafe.Sizeof(float64(0)))
+	sizeOfUint64  = int(unsafe.Sizeof(uint64(0)))
+)
+
+type countValuesKey struct {
+	groupID int
+	value   string
+}
+
+type countValuesStep struct {
+	t         int64
+	sampleIDs []uint64
+	counts    []float64
+}
+
+// countValuesOperator implements the count_values aggregation.
+// Since output series depend on the values of input samples, the operator
+// has to consume its entire input before it can return its series.
+type countValuesOperator struct {
+	pool  *model.VectorPool
+	next  model.VectorOperator
+	param string
+
+	by       bool
+	grouping []string
+
+	stepsBatch    int
+	sampleLimiter *query.SampleLimiter
+	memoryTracker *query.MemoryTracker
+
+	once        sync.Once
+	series      []labels.Labels
+	steps       []countValuesStep
+	currentStep int
+}
+
+func NewCountValues(
+	pool *model.VectorPool,
+	next model.VectorOperator,
+	param string,
+	by bool,
+	grouping []string,
+	stepsBatch int,
+	opts *query.Options,
+) model.VectorOperator {
+	// Grouping labels need to be sorted in order for metric hashing to work.
+	// https://github.com/prometheus/prometheus/blob/8ed39fdab1ead382a354e45ded999eb3610f8d5f/model/labels/labels.go#L162-L181
+	slices.Sort(grouping)
+	return &countValuesOperator{
+		pool:       pool,
+		next:       next,
+		param:      param,
+		by:         by,
+		grouping:   grouping,
+		stepsBatch: stepsBatch,
+
+		sampleLimiter: opts.SampleLimiter,
+		memoryTracker: opts.MemoryTracker,
+	}
+}
+
+func (c *countValuesOperator) Explain() (me string, next []model.VectorOperator) {
+	if c.by {
+		return fmt.Sprintf("[*countValuesOperator] count_values(%q) by (%v)", c.param, c.grouping), []model.VectorOperator{c.next}
+	}
+	return fmt.Sprintf("[*countValuesOperator] count_values(%q) without (%v)", c.param, c.grouping), []model.VectorOperator{c.next}
+}
+
+func (c *countValuesOperator) GetPool() *model.VectorPool {
+	return c.pool
+}
+
+func (c *countValuesOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	c.once.Do(func() { err = c.initializeSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return c.series, nil
+}
+
+func (c *countValuesOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var err error
+	c.once.Do(func() { err = c.initializeSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	if c.currentStep >= len(c.steps) {
+		return nil, nil
+	}
+
+	batch := c.pool.GetVectorBatch()
+	for i := 0; i < c.stepsBatch && c.currentStep < len(c.steps); i++ {
+		step := c.steps[c.currentStep]
+		sv := c.pool.GetStepVector(step.t)
+		sv.SampleIDs = append(sv.SampleIDs, step.sampleIDs...)
+		sv.Samples = append(sv.Samples, step.counts...)
+		batch = append(batch, sv)
+		c.memoryTracker.Free(step.size())
+		c.steps[c.currentStep] = countValuesStep{}
+		c.currentStep++
+	}
+	return batch, nil
+}
+
+func (c *countValuesOperator) initializeSeries(ctx context.Context) error {
+	if !prommodel.LabelName(c.param).IsValid() {
+		return errors.Newf("invalid label name %q", c.param)
+	}
+
+	nextSeries, err := c.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The value label is dropped from the output if it is part of the without clause.
+	setValueLabel := c.by || !slices.Contains(c.grouping, c.param)
+
+	var (
+		buf       = make([]byte, 1024)
+		groups    = make([]labels.Labels, 0)
+		groupIDs  = make(map[uint64]int)
+		inputToID = make([]int, len(nextSeries))
+	)
+	for i, s := range nextSeries {
+		lbls, _ := dropLabel(s.Copy(), c.param)
+		if !c.by {
+			lbls, _ = dropLabel(lbls, labels.MetricName)
+		}
+		hash, _, lbls := hashMetric(lbls, !c.by, c.grouping, buf)
+		groupID, ok := groupIDs[hash]
+		if !ok {
+			groupID = len(groups)
+			groupIDs[hash] = groupID
+			groups = append(groups, lbls)
+		}
+		inputToID[i] = groupID
+	}
+
+	var (
+		outputIDs = make(map[countValuesKey]int)
+		// stepIndex maps output series IDs to their position in the current step.
+		stepIndex = make(map[int]int)
+	)
+	for {
+		in, err := c.next.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if in == nil {
+			break
+		}
+		for _, vector := range in {
+			step := countValuesStep{t: vector.T}
+			for k := range stepIndex {
+				delete(stepIndex, k)
+			}
+			for i, sampleID := range vector.SampleIDs {
+				key := countValuesKey{groupID: inputToID[sampleID]}
+				if setValueLabel {
+					key.value = strconv.FormatFloat(vector.Samples[i], 'f', -1, 64)
+				}
+				outputID, ok := outputIDs[key]
+				if !ok {
+					lbls := groups[key.groupID]
+					if setValueLabel {
+						lbls = labels.NewBuilder(lbls).Set(c.param, key.value).Labels(nil)
+					}
+					outputID = len(c.series)
+					outputIDs[key] = outputID
+					c.series = append(c.series, lbls)
+				}
+
+				idx, ok := stepIndex[outputID]
+				if !ok {
+					idx = len(step.sampleIDs)
+					stepIndex[outputID] = idx
+					step.sampleIDs = append(step.sampleIDs, uint64(outputID))
+					step.counts = append(step.counts, 0)
+				}
+				step.counts[idx]++
+			}
+			c.steps = append(c.steps, step)
+			// Counts are held until the operator returns them, while the input is released.
+			if err := c.sampleLimiter.Add(len(step.counts)); err != nil {
+				return err
+			}
+			if err := c.memoryTracker.Alloc(step.size()); err != nil {
+				return err
+			}
+			c.sampleLimiter.Remove(vector.NumSamples())
+			c.next.GetPool().PutStepVector(vector)
+		}
+		c.next.GetPool().PutVectors(in)
+	}
+	c.pool.SetStepSize(len(c.series))
+
+	return nil
+}
+
+// size returns the number of bytes which are buffered for the step.
+func (s countValuesStep) size() int {
+	return cap(s.sampleIDs)*sizeOfUint64 + cap(s.counts)*sizeOfFloat64
+}
+
+// dropLabel removes the label with the given name from l.
+func dropLabel(l labels.Labels, name string) (labels.Labels, bool) {
+	for i := range l {
+		if l[i].Name == name {
+			return append(l[:i], l[i+1:]...), true
+		}
+	}
+	return l, false
+}
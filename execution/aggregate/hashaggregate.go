@@ -16,6 +16,7 @@ import (
 
 	"github.com/thanos-community/promql-engine/execution/model"
 	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/query"
 	"github.com/thanos-community/promql-engine/worker"
 )
 
@@ -36,7 +37,8 @@ type aggregate struct {
 	series         []labels.Labels
 	newAccumulator newAccumulatorFunc
 	stepsBatch     int
-	workers        worker.Group
+	workers        *worker.Group
+	sampleLimiter  *query.SampleLimiter
 }
 
 func NewHashAggregate(
@@ -47,6 +49,7 @@ func NewHashAggregate(
 	by bool,
 	labels []string,
 	stepsBatch int,
+	opts *query.Options,
 ) (model.VectorOperator, error) {
 	newAccumulator, err := makeAccumulatorFunc(aggregation)
 	if err != nil {
@@ -66,8 +69,9 @@ func NewHashAggregate(
 		labels:         labels,
 		stepsBatch:     stepsBatch,
 		newAccumulator: newAccumulator,
+		sampleLimiter:  opts.SampleLimiter,
 	}
-	a.workers = worker.NewGroup(stepsBatch, a.workerTask)
+	a.workers = worker.NewGroup(stepsBatch, opts.Parallelism, a.workerTask)
 
 	return a, nil
 }
@@ -138,17 +142,23 @@ func (a *aggregate) Next(ctx context.Context) ([]model.StepVector, error) {
 
 	result := a.vectorPool.GetVectorBatch()
 	for i, vector := range in {
-		if err = a.workers[i].Send(a.params[i], vector); err != nil {
+		if err = a.workers.Send(i, a.params[i], vector); err != nil {
 			return nil, err
 		}
 	}
 
-	for i, vector := range in {
-		output, err := a.workers[i].GetOutput()
+	for i := range in {
+		output, err := a.workers.GetOutput(i)
 		if err != nil {
 			return nil, err
 		}
 		result = append(result, output)
+	}
+	if err := a.sampleLimiter.Add(model.NumSamples(result)); err != nil {
+		return nil, err
+	}
+	a.sampleLimiter.Remove(model.NumSamples(in))
+	for _, vector := range in {
 		a.next.GetPool().PutStepVector(vector)
 	}
 
@@ -177,8 +187,8 @@ func (a *aggregate) initializeTables(ctx context.Context) error {
 	return nil
 }
 
-func (a *aggregate) workerTask(workerID int, arg float64, vector model.StepVector) model.StepVector {
-	table := a.tables[workerID]
+func (a *aggregate) workerTask(stepID int, arg float64, vector model.StepVector) model.StepVector {
+	table := a.tables[stepID]
 	table.aggregate(arg, vector)
 	return table.toVector(a.vectorPool)
 }
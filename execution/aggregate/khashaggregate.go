@@ -17,6 +17,7 @@ import (
 	"golang.org/x/exp/slices"
 
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 type kAggregate struct {
@@ -36,6 +37,8 @@ type kAggregate struct {
 	inputToHeap []*samplesHeap
 	heaps       []*samplesHeap
 	compare     func(float64, float64) bool
+
+	sampleLimiter *query.SampleLimiter
 }
 
 func NewKHashAggregate(
@@ -46,6 +49,7 @@ func NewKHashAggregate(
 	by bool,
 	labels []string,
 	stepsBatch int,
+	opts *query.Options,
 ) (model.VectorOperator, error) {
 	var compare func(float64, float64) bool
 
@@ -71,6 +75,8 @@ func NewKHashAggregate(
 		paramOp:     paramOp,
 		compare:     compare,
 		params:      make([]float64, stepsBatch),
+
+		sampleLimiter: opts.SampleLimiter,
 	}
 
 	return a, nil
@@ -112,6 +118,12 @@ func (a *kAggregate) Next(ctx context.Context) ([]model.StepVector, error) {
 	result := a.vectorPool.GetVectorBatch()
 	for i, vector := range in {
 		a.aggregate(vector.T, &result, int(a.params[i]), vector.SampleIDs, vector.Samples)
+	}
+	if err := a.sampleLimiter.Add(model.NumSamples(result)); err != nil {
+		return nil, err
+	}
+	a.sampleLimiter.Remove(model.NumSamples(in))
+	for _, vector := range in {
 		a.next.GetPool().PutStepVector(vector)
 	}
 
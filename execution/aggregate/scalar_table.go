@@ -6,9 +6,9 @@ package aggregate
 import (
 	"fmt"
 	"math"
-	"sort"
 
 	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 
@@ -56,6 +56,9 @@ func (t *scalarTable) aggregate(arg float64, vector model.StepVector) {
 	for i := range vector.Samples {
 		t.addSample(vector.T, vector.SampleIDs[i], vector.Samples[i])
 	}
+	for i := range vector.Histograms {
+		t.addHistogram(vector.T, vector.HistogramIDs[i], vector.Histograms[i])
+	}
 }
 
 func (t *scalarTable) addSample(ts int64, sampleID uint64, sample float64) {
@@ -66,6 +69,18 @@ func (t *scalarTable) addSample(ts int64, sampleID uint64, sample float64) {
 	t.accumulators[output.ID].AddFunc(sample)
 }
 
+func (t *scalarTable) addHistogram(ts int64, sampleID uint64, h *histogram.FloatHistogram) {
+	outputSampleID := t.inputs[sampleID]
+	output := t.outputs[outputSampleID]
+
+	accumulator := t.accumulators[output.ID]
+	if accumulator.AddHistogramFunc == nil {
+		return
+	}
+	t.timestamp = ts
+	accumulator.AddHistogramFunc(h)
+}
+
 func (t *scalarTable) reset(arg float64) {
 	for i := range t.outputs {
 		t.accumulators[i].Reset(arg)
@@ -75,10 +90,17 @@ func (t *scalarTable) reset(arg float64) {
 func (t *scalarTable) toVector(pool *model.VectorPool) model.StepVector {
 	result := pool.GetStepVector(t.timestamp)
 	for i, v := range t.outputs {
-		if t.accumulators[i].HasValue() {
-			result.SampleIDs = append(result.SampleIDs, v.ID)
-			result.Samples = append(result.Samples, t.accumulators[i].ValueFunc())
+		if !t.accumulators[i].HasValue() {
+			continue
+		}
+		if t.accumulators[i].HistogramValueFunc != nil {
+			if h := t.accumulators[i].HistogramValueFunc(); h != nil {
+				result.AppendHistogram(pool, v.ID, h)
+				continue
+			}
 		}
+		result.SampleIDs = append(result.SampleIDs, v.ID)
+		result.Samples = append(result.Samples, t.accumulators[i].ValueFunc())
 	}
 	return result
 }
@@ -113,6 +135,11 @@ type accumulator struct {
 	ValueFunc func() float64
 	HasValue  func() bool
 	Reset     func(arg float64)
+
+	// AddHistogramFunc and HistogramValueFunc are only set for
+	// aggregations which support native histograms.
+	AddHistogramFunc   func(h *histogram.FloatHistogram)
+	HistogramValueFunc func() *histogram.FloatHistogram
 }
 
 func makeAccumulatorFunc(expr parser.ItemType) (newAccumulatorFunc, error) {
@@ -121,18 +148,27 @@ func makeAccumulatorFunc(expr parser.ItemType) (newAccumulatorFunc, error) {
 	case "sum":
 		return func() *accumulator {
 			var value float64
-			var hasValue bool
+			var histogramValue *histogram.FloatHistogram
+			var hasFloat, hasHistogram bool
 
 			return &accumulator{
 				AddFunc: func(v float64) {
-					hasValue = true
+					hasFloat = true
 					value += v
 				},
-				ValueFunc: func() float64 { return value },
-				HasValue:  func() bool { return hasValue },
+				AddHistogramFunc: func(h *histogram.FloatHistogram) {
+					hasHistogram = true
+					histogramValue = addHistogram(histogramValue, h)
+				},
+				ValueFunc:          func() float64 { return value },
+				HistogramValueFunc: func() *histogram.FloatHistogram { return histogramValue },
+				// Float samples cannot be aggregated together with histograms.
+				HasValue: func() bool { return hasFloat != hasHistogram },
 				Reset: func(_ float64) {
-					hasValue = false
+					hasFloat = false
+					hasHistogram = false
 					value = 0
+					histogramValue = nil
 				},
 			}
 		}, nil
@@ -190,6 +226,10 @@ func makeAccumulatorFunc(expr parser.ItemType) (newAccumulatorFunc, error) {
 					hasValue = true
 					value += 1
 				},
+				AddHistogramFunc: func(h *histogram.FloatHistogram) {
+					hasValue = true
+					value += 1
+				},
 				ValueFunc: func() float64 { return value },
 				HasValue:  func() bool { return hasValue },
 				Reset: func(_ float64) {
@@ -225,6 +265,9 @@ func makeAccumulatorFunc(expr parser.ItemType) (newAccumulatorFunc, error) {
 				AddFunc: func(v float64) {
 					hasValue = true
 				},
+				AddHistogramFunc: func(h *histogram.FloatHistogram) {
+					hasValue = true
+				},
 				ValueFunc: func() float64 { return 1 },
 				HasValue:  func() bool { return hasValue },
 				Reset: func(_ float64) {
@@ -295,7 +338,7 @@ func makeAccumulatorFunc(expr parser.ItemType) (newAccumulatorFunc, error) {
 					points = append(points, v)
 				},
 				ValueFunc: func() float64 {
-					return quantile(arg, points)
+					return function.Quantile(arg, points)
 				},
 				HasValue: func() bool { return hasValue },
 				Reset: func(a float64) {
@@ -310,26 +353,15 @@ func makeAccumulatorFunc(expr parser.ItemType) (newAccumulatorFunc, error) {
 	return nil, errors.Wrap(parse.ErrNotSupportedExpr, msg)
 }
 
-func quantile(q float64, points []float64) float64 {
-	if len(points) == 0 || math.IsNaN(q) {
-		return math.NaN()
-	}
-	if q < 0 {
-		return math.Inf(-1)
+// addHistogram adds h to sum and returns the result. The histogram
+// with the larger schema is always added to the one with the smaller schema,
+// and input histograms are never modified.
+func addHistogram(sum, h *histogram.FloatHistogram) *histogram.FloatHistogram {
+	if sum == nil {
+		return h.Copy()
 	}
-	if q > 1 {
-		return math.Inf(+1)
+	if h.Schema >= sum.Schema {
+		return sum.Add(h)
 	}
-	sort.Float64s(points)
-
-	n := float64(len(points))
-	// When the quantile lies between two samples,
-	// we use a weighted average of the two samples.
-	rank := q * (n - 1)
-
-	lowerIndex := math.Max(0, math.Floor(rank))
-	upperIndex := math.Min(n-1, lowerIndex+1)
-
-	weight := rank - math.Floor(rank)
-	return points[int(lowerIndex)]*(1-weight) + points[int(upperIndex)]*weight
+	return h.Copy().Add(sum)
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/efficientgo/core/errors"
 
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/promql/parser"
 	"gonum.org/v1/gonum/floats"
 
@@ -15,11 +16,14 @@ import (
 	"github.com/thanos-community/promql-engine/execution/parse"
 )
 
-type vectorAccumulator func([]float64) float64
+// vectorAccumulator aggregates all float and histogram samples of a step vector.
+// The returned bool is false if the aggregation produces no result.
+type vectorAccumulator func([]float64, []*histogram.FloatHistogram) (float64, *histogram.FloatHistogram, bool)
 
 type vectorTable struct {
 	timestamp   int64
 	value       float64
+	histogram   *histogram.FloatHistogram
 	hasValue    bool
 	accumulator vectorAccumulator
 }
@@ -44,13 +48,12 @@ func newVectorizedTable(a vectorAccumulator) *vectorTable {
 }
 
 func (t *vectorTable) aggregate(_ float64, vector model.StepVector) {
-	if len(vector.SampleIDs) == 0 {
+	if len(vector.SampleIDs) == 0 && len(vector.HistogramIDs) == 0 {
 		t.hasValue = false
 		return
 	}
-	t.hasValue = true
 	t.timestamp = vector.T
-	t.value = t.accumulator(vector.Samples)
+	t.value, t.histogram, t.hasValue = t.accumulator(vector.Samples, vector.Histograms)
 }
 
 func (t *vectorTable) toVector(pool *model.VectorPool) model.StepVector {
@@ -60,6 +63,10 @@ func (t *vectorTable) toVector(pool *model.VectorPool) model.StepVector {
 	}
 
 	result.T = t.timestamp
+	if t.histogram != nil {
+		result.AppendHistogram(pool, 0, t.histogram)
+		return result
+	}
 	result.SampleIDs = append(result.SampleIDs, 0)
 	result.Samples = append(result.Samples, t.value)
 	return result
@@ -73,24 +80,48 @@ func newVectorAccumulator(expr parser.ItemType) (vectorAccumulator, error) {
 	t := parser.ItemTypeStr[expr]
 	switch t {
 	case "sum":
-		return floats.Sum, nil
+		return func(in []float64, histograms []*histogram.FloatHistogram) (float64, *histogram.FloatHistogram, bool) {
+			if len(histograms) == 0 {
+				return floats.Sum(in), nil, true
+			}
+			// Float samples cannot be aggregated together with histograms.
+			if len(in) > 0 {
+				return 0, nil, false
+			}
+			var sum *histogram.FloatHistogram
+			for _, h := range histograms {
+				sum = addHistogram(sum, h)
+			}
+			return 0, sum, true
+		}, nil
 	case "max":
-		return floats.Max, nil
+		return floatsOnly(floats.Max), nil
 	case "min":
-		return floats.Min, nil
+		return floatsOnly(floats.Min), nil
 	case "count":
-		return func(in []float64) float64 {
-			return float64(len(in))
+		return func(in []float64, histograms []*histogram.FloatHistogram) (float64, *histogram.FloatHistogram, bool) {
+			return float64(len(in) + len(histograms)), nil, true
 		}, nil
 	case "avg":
-		return func(in []float64) float64 {
+		return floatsOnly(func(in []float64) float64 {
 			return floats.Sum(in) / float64(len(in))
-		}, nil
+		}), nil
 	case "group":
-		return func(in []float64) float64 {
-			return 1
+		return func([]float64, []*histogram.FloatHistogram) (float64, *histogram.FloatHistogram, bool) {
+			return 1, nil, true
 		}, nil
 	}
 	msg := fmt.Sprintf("unknown aggregation function %s", t)
 	return nil, errors.Wrap(parse.ErrNotSupportedExpr, msg)
 }
+
+// floatsOnly creates a vectorAccumulator which ignores histograms
+// and produces no result for vectors without float samples.
+func floatsOnly(f func([]float64) float64) vectorAccumulator {
+	return func(in []float64, _ []*histogram.FloatHistogram) (float64, *histogram.FloatHistogram, bool) {
+		if len(in) == 0 {
+			return 0, nil, false
+		}
+		return f(in), nil, true
+	}
+}
@@ -9,11 +9,14 @@ import (
 	"math"
 	"sync"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/thanos-community/promql-engine/execution/function"
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 type ScalarSide int
@@ -42,6 +45,8 @@ type scalarOperator struct {
 
 	// Keep the result if both sides are scalars.
 	bothScalars bool
+
+	sampleLimiter *query.SampleLimiter
 }
 
 func NewScalar(
@@ -51,6 +56,7 @@ func NewScalar(
 	op parser.ItemType,
 	scalarSide ScalarSide,
 	returnBool bool,
+	opts *query.Options,
 ) (*scalarOperator, error) {
 	binaryOperation, err := newOperation(op, scalarSide != ScalarSideBoth)
 	if err != nil {
@@ -75,6 +81,7 @@ func NewScalar(
 		operandValIdx: operandValIdx,
 		returnBool:    returnBool,
 		bothScalars:   scalarSide == ScalarSideBoth,
+		sampleLimiter: opts.SampleLimiter,
 	}, nil
 }
 
@@ -114,7 +121,12 @@ func (o *scalarOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	if err != nil {
 		return nil, err
 	}
+	if hasHistograms(in) {
+		return nil, errors.Wrapf(parse.ErrNotImplemented, "binary operation %s between native histograms and scalars", parser.ItemTypeStr[o.opType])
+	}
 
+	// Inputs are counted before their vectors are returned to the pool.
+	numInputSamples := model.NumSamples(in)
 	out := o.pool.GetVectorBatch()
 	for v, vector := range in {
 		step := o.pool.GetStepVector(vector.T)
@@ -150,6 +162,11 @@ func (o *scalarOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	o.next.GetPool().PutVectors(in)
 	o.scalar.GetPool().PutVectors(scalarIn)
 
+	if err := o.sampleLimiter.Add(model.NumSamples(out)); err != nil {
+		return nil, err
+	}
+	o.sampleLimiter.Remove(numInputSamples)
+
 	return out, nil
 }
 
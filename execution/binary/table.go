@@ -6,6 +6,7 @@ package binary
 import (
 	"math"
 
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/thanos-community/promql-engine/execution/model"
@@ -39,6 +40,7 @@ type outputSample struct {
 	lhSampleID uint64
 	rhSampleID uint64
 	v          float64
+	h          *histogram.FloatHistogram
 }
 
 type table struct {
@@ -104,6 +106,21 @@ func (t *table) execBinaryOperation(lhs model.StepVector, rhs model.StepVector,
 			t.outputValues[outputSampleID].lhSampleID = sampleID
 			t.outputValues[outputSampleID].lhT = lhs.T
 			t.outputValues[outputSampleID].v = lhsVal
+			t.outputValues[outputSampleID].h = nil
+		}
+	}
+	for i, sampleID := range lhs.HistogramIDs {
+		outputSampleIDs := lhsIndex.outputSamples(sampleID)
+		for _, outputSampleID := range outputSampleIDs {
+			if t.card != parser.CardManyToOne && t.outputValues[outputSampleID].lhT == ts {
+				prevSampleID := t.outputValues[outputSampleID].lhSampleID
+				return model.StepVector{}, newManyToManyMatchError(prevSampleID, sampleID, lhBinOpSide)
+			}
+
+			t.outputValues[outputSampleID].lhSampleID = sampleID
+			t.outputValues[outputSampleID].lhT = lhs.T
+			t.outputValues[outputSampleID].v = 0
+			t.outputValues[outputSampleID].h = lhs.Histograms[i]
 		}
 	}
 
@@ -111,16 +128,14 @@ func (t *table) execBinaryOperation(lhs model.StepVector, rhs model.StepVector,
 		rhVal := rhs.Samples[i]
 		outputSampleIDs := rhsIndex.outputSamples(sampleID)
 		for _, outputSampleID := range outputSampleIDs {
-			outputSample := t.outputValues[outputSampleID]
-			if rhs.T != outputSample.lhT {
-				continue
+			outputSample, err := t.matchRightSample(outputSampleID, sampleID, rhs.T)
+			if err != nil {
+				return model.StepVector{}, err
 			}
-			if t.card != parser.CardOneToMany && outputSample.rhT == rhs.T {
-				prevSampleID := t.outputValues[outputSampleID].rhSampleID
-				return model.StepVector{}, newManyToManyMatchError(prevSampleID, sampleID, rhBinOpSide)
+			// Samples are only matched with samples of the same type.
+			if outputSample == nil || outputSample.h != nil {
+				continue
 			}
-			t.outputValues[outputSampleID].rhSampleID = sampleID
-			t.outputValues[outputSampleID].rhT = rhs.T
 
 			outputVal, keep := t.operation([2]float64{outputSample.v, rhVal}, 0)
 			if returnBool {
@@ -136,9 +151,50 @@ func (t *table) execBinaryOperation(lhs model.StepVector, rhs model.StepVector,
 		}
 	}
 
+	// Histograms can only be added, the operator rejects other operations on histograms.
+	for i, sampleID := range rhs.HistogramIDs {
+		rhH := rhs.Histograms[i]
+		outputSampleIDs := rhsIndex.outputSamples(sampleID)
+		for _, outputSampleID := range outputSampleIDs {
+			outputSample, err := t.matchRightSample(outputSampleID, sampleID, rhs.T)
+			if err != nil {
+				return model.StepVector{}, err
+			}
+			if outputSample == nil || outputSample.h == nil {
+				continue
+			}
+
+			// The histogram being added must have the larger schema
+			// code (i.e. the higher resolution).
+			var outputH *histogram.FloatHistogram
+			if rhH.Schema >= outputSample.h.Schema {
+				outputH = outputSample.h.Copy().Add(rhH)
+			} else {
+				outputH = rhH.Copy().Add(outputSample.h)
+			}
+			step.AppendHistogram(t.pool, outputSampleID, outputH)
+		}
+	}
+
 	return step, nil
 }
 
+// matchRightSample records that the sample of the right hand side with the given ID matched the output sample
+// at time ts. It returns a copy of the output sample, or nil if the left hand side has no sample at time ts.
+func (t *table) matchRightSample(outputSampleID, sampleID uint64, ts int64) (*outputSample, *errManyToManyMatch) {
+	outputSample := t.outputValues[outputSampleID]
+	if ts != outputSample.lhT {
+		return nil, nil
+	}
+	if t.card != parser.CardOneToMany && outputSample.rhT == ts {
+		prevSampleID := t.outputValues[outputSampleID].rhSampleID
+		return nil, newManyToManyMatchError(prevSampleID, sampleID, rhBinOpSide)
+	}
+	t.outputValues[outputSampleID].rhSampleID = sampleID
+	t.outputValues[outputSampleID].rhT = ts
+	return &outputSample, nil
+}
+
 // operands is a length 2 array which contains lhs and rhs.
 // valueIdx is used in vector comparison operator to decide
 // which operand value we should return.
@@ -210,3 +266,13 @@ func btof(b bool) float64 {
 	}
 	return 0
 }
+
+// hasHistograms returns true if any of the vectors contains native histograms.
+func hasHistograms(vectors []model.StepVector) bool {
+	for _, v := range vectors {
+		if len(v.HistogramIDs) > 0 {
+			return true
+		}
+	}
+	return false
+}
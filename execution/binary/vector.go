@@ -14,6 +14,8 @@ import (
 	"golang.org/x/exp/slices"
 
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 // vectorOperator evaluates an expression between two step vectors.
@@ -42,6 +44,8 @@ type vectorOperator struct {
 
 	// If true then 1/0 needs to be returned instead of the value.
 	returnBool bool
+
+	sampleLimiter *query.SampleLimiter
 }
 
 func NewVectorOperator(
@@ -51,6 +55,7 @@ func NewVectorOperator(
 	matching *parser.VectorMatching,
 	operation parser.ItemType,
 	returnBool bool,
+	opts *query.Options,
 ) (model.VectorOperator, error) {
 	op, err := newOperation(operation, true)
 	if err != nil {
@@ -72,6 +77,7 @@ func NewVectorOperator(
 		operation:      op,
 		opType:         operation,
 		returnBool:     returnBool,
+		sampleLimiter:  opts.SampleLimiter,
 	}, nil
 }
 
@@ -181,7 +187,12 @@ func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	if err != nil {
 		return nil, err
 	}
+	if o.opType != parser.ADD && (hasHistograms(lhs) || hasHistograms(rhs)) {
+		return nil, errors.Wrapf(parse.ErrNotImplemented, "binary operation %s on native histograms", parser.ItemTypeStr[o.opType])
+	}
 
+	// Inputs are counted before their vectors are returned to the pool.
+	numInputSamples := model.NumSamples(lhs) + model.NumSamples(rhs)
 	batch := o.pool.GetVectorBatch()
 	for i, vector := range lhs {
 		if i < len(rhs) {
@@ -211,6 +222,11 @@ func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	o.lhs.GetPool().PutVectors(lhs)
 	o.rhs.GetPool().PutVectors(rhs)
 
+	if err := o.sampleLimiter.Add(model.NumSamples(batch)); err != nil {
+		return nil, err
+	}
+	o.sampleLimiter.Remove(numInputSamples)
+
 	return batch, nil
 }
 
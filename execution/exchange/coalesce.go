@@ -31,17 +31,54 @@ type coalesceOperator struct {
 
 	pool          *model.VectorPool
 	mu            sync.Mutex
-	wg            sync.WaitGroup
 	operators     []model.VectorOperator
 	sampleOffsets []uint64
+
+	// parallelism is the number of goroutines which call the operators concurrently.
+	parallelism int
 }
 
-func NewCoalesce(pool *model.VectorPool, operators ...model.VectorOperator) model.VectorOperator {
+// NewCoalesce creates an operator which merges the outputs of operators. The operators are
+// called by at most parallelism goroutines, and a non-positive value calls all of them concurrently.
+func NewCoalesce(pool *model.VectorPool, parallelism int, operators ...model.VectorOperator) model.VectorOperator {
+	if parallelism <= 0 || parallelism > len(operators) {
+		parallelism = len(operators)
+	}
 	return &coalesceOperator{
 		pool:          pool,
 		operators:     operators,
 		sampleOffsets: make([]uint64, len(operators)),
+		parallelism:   parallelism,
+	}
+}
+
+// forEachOperator calls f with the index of each operator from at most parallelism goroutines,
+// and waits until all calls returned. Without parallelism, f is called by the calling goroutine.
+func (c *coalesceOperator) forEachOperator(f func(opIdx int)) {
+	if c.parallelism <= 1 {
+		for i := range c.operators {
+			f(i)
+		}
+		return
+	}
+
+	indexes := make(chan int, len(c.operators))
+	for i := range c.operators {
+		indexes <- i
+	}
+	close(indexes)
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for opIdx := range indexes {
+				f(opIdx)
+			}
+		}()
 	}
+	wg.Wait()
 }
 
 func (c *coalesceOperator) Explain() (me string, next []model.VectorOperator) {
@@ -76,49 +113,50 @@ func (c *coalesceOperator) Next(ctx context.Context) ([]model.StepVector, error)
 
 	var out []model.StepVector = nil
 	var errChan = make(errorChan, len(c.operators))
-	for idx, o := range c.operators {
-		c.wg.Add(1)
-		go func(opIdx int, o model.VectorOperator) {
-			defer c.wg.Done()
-
-			in, err := o.Next(ctx)
-			if err != nil {
-				errChan <- err
-				return
-			}
-			if in == nil {
-				return
-			}
+	c.forEachOperator(func(opIdx int) {
+		o := c.operators[opIdx]
+		in, err := o.Next(ctx)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		if in == nil {
+			return
+		}
 
-			for _, vector := range in {
-				for i := range vector.SampleIDs {
-					vector.SampleIDs[i] += c.sampleOffsets[opIdx]
-				}
+		for _, vector := range in {
+			for i := range vector.SampleIDs {
+				vector.SampleIDs[i] += c.sampleOffsets[opIdx]
+			}
+			for i := range vector.HistogramIDs {
+				vector.HistogramIDs[i] += c.sampleOffsets[opIdx]
 			}
+		}
 
-			c.mu.Lock()
-			defer c.mu.Unlock()
+		c.mu.Lock()
+		defer c.mu.Unlock()
 
-			if len(in) > 0 && out == nil {
-				out = c.pool.GetVectorBatch()
-				for i := 0; i < len(in); i++ {
-					out = append(out, c.pool.GetStepVector(in[i].T))
-				}
+		if len(in) > 0 && out == nil {
+			out = c.pool.GetVectorBatch()
+			for i := 0; i < len(in); i++ {
+				out = append(out, c.pool.GetStepVector(in[i].T))
 			}
+		}
 
-			for i := 0; i < len(in); i++ {
-				if len(in[i].Samples) > 0 {
-					out[i].T = in[i].T
-				}
+		for i := 0; i < len(in); i++ {
+			if len(in[i].Samples) > 0 || len(in[i].Histograms) > 0 {
+				out[i].T = in[i].T
+			}
 
-				out[i].Samples = append(out[i].Samples, in[i].Samples...)
-				out[i].SampleIDs = append(out[i].SampleIDs, in[i].SampleIDs...)
-				o.GetPool().PutStepVector(in[i])
+			out[i].Samples = append(out[i].Samples, in[i].Samples...)
+			out[i].SampleIDs = append(out[i].SampleIDs, in[i].SampleIDs...)
+			for j := range in[i].Histograms {
+				out[i].AppendHistogram(c.pool, in[i].HistogramIDs[j], in[i].Histograms[j])
 			}
-			o.GetPool().PutVectors(in)
-		}(idx, o)
-	}
-	c.wg.Wait()
+			o.GetPool().PutStepVector(in[i])
+		}
+		o.GetPool().PutVectors(in)
+	})
 	close(errChan)
 
 	if err := errChan.getError(); err != nil {
@@ -133,40 +171,34 @@ func (c *coalesceOperator) Next(ctx context.Context) ([]model.StepVector, error)
 }
 
 func (c *coalesceOperator) loadSeries(ctx context.Context) error {
-	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var numSeries uint64
 	allSeries := make([][]labels.Labels, len(c.operators))
 	errChan := make(errorChan, len(c.operators))
-	for i := 0; i < len(c.operators); i++ {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			defer func() {
-				e := recover()
-				if e == nil {
-					return
-				}
-
-				switch err := e.(type) {
-				case error:
-					errChan <- errors.Wrapf(err, "unexpected error")
-				}
-
-			}()
-			series, err := c.operators[i].Series(ctx)
-			if err != nil {
-				errChan <- err
+	c.forEachOperator(func(i int) {
+		defer func() {
+			e := recover()
+			if e == nil {
 				return
 			}
 
-			allSeries[i] = series
-			mu.Lock()
-			numSeries += uint64(len(series))
-			mu.Unlock()
-		}(i)
-	}
-	wg.Wait()
+			switch err := e.(type) {
+			case error:
+				errChan <- errors.Wrapf(err, "unexpected error")
+			}
+
+		}()
+		series, err := c.operators[i].Series(ctx)
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		allSeries[i] = series
+		mu.Lock()
+		numSeries += uint64(len(series))
+		mu.Unlock()
+	})
 	close(errChan)
 	if err := errChan.getError(); err != nil {
 		return err
@@ -0,0 +1,221 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package exchange
+
+import (
+	"context"
+	"math"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+const (
+	// noReplica marks deduplicated series for which no input series was selected yet.
+	noReplica = math.MaxUint64
+	// initialPenalty is the penalty in milliseconds of replicas which were not selected for
+	// the first sample of a series, before the interval between its samples is known.
+	initialPenalty = 5000
+)
+
+type dedupSample struct {
+	set       bool
+	inputID   uint64
+	index     int
+	histogram bool
+}
+
+// dedupOperator merges series which only differ in their replica labels into a single series.
+// Like the penalty-based deduplication in Thanos, each merged series keeps taking samples from
+// the input series it was last selected from. When a sample is selected, the other replicas get
+// a penalty of twice the interval to the previously selected sample, and their samples are only
+// selected again once they are later than the previous sample plus their penalty. Replicas are
+// therefore only switched after a gap in the selected one, which avoids mixing samples of replicas
+// whose values differ slightly because they were scraped at different times.
+type dedupOperator struct {
+	once   sync.Once
+	series []labels.Labels
+
+	pool          *model.VectorPool
+	next          model.VectorOperator
+	replicaLabels []string
+	sampleLimiter *query.SampleLimiter
+
+	// outputIDs maps the ID of each input series to the ID of its merged series,
+	// and inputIDs holds the IDs of the input series of each merged series.
+	outputIDs []uint64
+	inputIDs  [][]uint64
+	// replicas holds the ID of the input series which was last selected for each merged series,
+	// and lastTs holds the timestamp of the sample which was last selected.
+	replicas []uint64
+	lastTs   []int64
+	// penalties holds the penalty in milliseconds of each input series.
+	penalties []int64
+	// samples holds the sample which is selected for each merged series in a step.
+	samples []dedupSample
+	touched []uint64
+}
+
+// NewDedup creates an operator which deduplicates the series of next, which
+// are expected to come from replicas identified by replicaLabels.
+func NewDedup(pool *model.VectorPool, next model.VectorOperator, replicaLabels []string, opts *query.Options) model.VectorOperator {
+	return &dedupOperator{
+		pool:          pool,
+		next:          next,
+		replicaLabels: replicaLabels,
+		sampleLimiter: opts.SampleLimiter,
+	}
+}
+
+func (d *dedupOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*dedupOperator]", []model.VectorOperator{d.next}
+}
+
+func (d *dedupOperator) GetPool() *model.VectorPool {
+	return d.pool
+}
+
+func (d *dedupOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	d.once.Do(func() { err = d.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return d.series, nil
+}
+
+func (d *dedupOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var err error
+	d.once.Do(func() { err = d.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := d.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if in == nil {
+		return nil, nil
+	}
+
+	result := d.pool.GetVectorBatch()
+	for _, vector := range in {
+		for i, inputID := range vector.SampleIDs {
+			d.selectSample(inputID, vector.T, i, false)
+		}
+		for i, inputID := range vector.HistogramIDs {
+			d.selectSample(inputID, vector.T, i, true)
+		}
+
+		out := d.pool.GetStepVector(vector.T)
+		for _, outputID := range d.touched {
+			s := d.samples[outputID]
+			d.updatePenalties(outputID, s.inputID, vector.T)
+			if s.histogram {
+				out.AppendHistogram(d.pool, outputID, vector.Histograms[s.index])
+			} else {
+				out.SampleIDs = append(out.SampleIDs, outputID)
+				out.Samples = append(out.Samples, vector.Samples[s.index])
+			}
+			d.samples[outputID] = dedupSample{}
+		}
+		d.touched = d.touched[:0]
+		result = append(result, out)
+	}
+
+	if err := d.sampleLimiter.Add(model.NumSamples(result)); err != nil {
+		return nil, err
+	}
+	d.sampleLimiter.Remove(model.NumSamples(in))
+
+	for i := range in {
+		d.next.GetPool().PutStepVector(in[i])
+	}
+	d.next.GetPool().PutVectors(in)
+	return result, nil
+}
+
+// selectSample selects the sample of the input series at time t for its merged series if the
+// penalty of the input series has passed. Of the input series with a sample in the step, the one
+// which was used for the merged series before is preferred, followed by the one with the lowest ID.
+func (d *dedupOperator) selectSample(inputID uint64, t int64, index int, histogram bool) {
+	outputID := d.outputIDs[inputID]
+	if t <= d.lastTs[outputID]+d.penalties[inputID] {
+		return
+	}
+	s := &d.samples[outputID]
+	if !s.set {
+		d.touched = append(d.touched, outputID)
+	} else if s.inputID == d.replicas[outputID] || (inputID != d.replicas[outputID] && inputID > s.inputID) {
+		return
+	}
+	*s = dedupSample{set: true, inputID: inputID, index: index, histogram: histogram}
+}
+
+// updatePenalties records that the sample of the input series at time t was selected for its merged
+// series, and sets the penalty of the other input series to twice the interval to the last sample.
+func (d *dedupOperator) updatePenalties(outputID, inputID uint64, t int64) {
+	penalty := int64(initialPenalty)
+	if d.replicas[outputID] != noReplica {
+		penalty = 2 * (t - d.lastTs[outputID])
+	}
+	for _, id := range d.inputIDs[outputID] {
+		d.penalties[id] = penalty
+	}
+	d.penalties[inputID] = 0
+	d.replicas[outputID] = inputID
+	d.lastTs[outputID] = t
+}
+
+func (d *dedupOperator) loadSeries(ctx context.Context) error {
+	series, err := d.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		builder = labels.NewBuilder(nil)
+		hashes  = make(map[uint64]uint64)
+	)
+	d.outputIDs = make([]uint64, len(series))
+	d.series = make([]labels.Labels, 0, len(series))
+	for i, s := range series {
+		builder.Reset(s)
+		lbls := builder.Del(d.replicaLabels...).Labels(nil)
+		h := lbls.Hash()
+		outputID, ok := hashes[h]
+		if !ok {
+			outputID = uint64(len(d.series))
+			hashes[h] = outputID
+			d.series = append(d.series, lbls)
+		}
+		d.outputIDs[i] = outputID
+	}
+
+	d.inputIDs = make([][]uint64, len(d.series))
+	for inputID, outputID := range d.outputIDs {
+		d.inputIDs[outputID] = append(d.inputIDs[outputID], uint64(inputID))
+	}
+	d.replicas = make([]uint64, len(d.series))
+	d.lastTs = make([]int64, len(d.series))
+	for i := range d.replicas {
+		d.replicas[i] = noReplica
+		d.lastTs[i] = math.MinInt64
+	}
+	d.penalties = make([]int64, len(series))
+	d.samples = make([]dedupSample, len(d.series))
+	d.touched = make([]uint64, 0, len(d.series))
+	d.pool.SetStepSize(len(d.series))
+	return nil
+}
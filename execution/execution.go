@@ -17,7 +17,6 @@
 package execution
 
 import (
-	"runtime"
 	"time"
 
 	"github.com/prometheus/prometheus/promql"
@@ -40,6 +39,7 @@ import (
 	"github.com/thanos-community/promql-engine/execution/scan"
 	"github.com/thanos-community/promql-engine/execution/step_invariant"
 	engstore "github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/execution/telemetry"
 	"github.com/thanos-community/promql-engine/execution/unary"
 	"github.com/thanos-community/promql-engine/logicalplan"
 	"github.com/thanos-community/promql-engine/query"
@@ -49,42 +49,54 @@ const stepsBatch = 10
 
 // New creates new physical query execution for a given query expression which represents logical plan.
 // TODO(bwplotka): Add definition (could be parameters for each execution operator) we can optimize - it would represent physical plan.
-func New(expr parser.Expr, queryable storage.Queryable, mint, maxt time.Time, step, lookbackDelta time.Duration) (model.VectorOperator, error) {
-	opts := &query.Options{
-		Start:         mint,
-		End:           maxt,
-		Step:          step,
-		LookbackDelta: lookbackDelta,
-		StepsBatch:    stepsBatch,
-	}
-	selectorPool := engstore.NewSelectorPool(queryable)
+func New(expr parser.Expr, queryable storage.Queryable, queryOpts *query.Options) (model.VectorOperator, error) {
+	opts := *queryOpts
+	opts.StepsBatch = stepsBatch
+
+	selectorPool := engstore.NewSelectorPool(queryable, opts.MemoryTracker)
 	hints := storage.SelectHints{
-		Start: mint.UnixMilli(),
-		End:   maxt.UnixMilli(),
-		// TODO(fpetkovski): Adjust the step for sub-queries once they are supported.
-		Step: step.Milliseconds(),
+		Start: opts.Start.UnixMilli(),
+		End:   opts.End.UnixMilli(),
+		Step:  opts.Step.Milliseconds(),
 	}
-	return newOperator(expr, selectorPool, opts, hints)
+	return newOperator(expr, selectorPool, &opts, hints)
 }
 
+// newOperator creates the operator for the given expression. When analysis or tracing is
+// enabled, the operator is wrapped so that its execution statistics are recorded.
 func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	op, err := newExprOperator(expr, storage, opts, hints)
+	if err != nil {
+		return nil, parse.WithReason(err, expr)
+	}
+	return instrument(op, opts), nil
+}
+
+func instrument(op model.VectorOperator, opts *query.Options) model.VectorOperator {
+	if !opts.EnableAnalysis && !opts.EnableTracing {
+		return op
+	}
+	return telemetry.NewOperator(op, opts.EnableTracing)
+}
+
+func newExprOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
 	switch e := expr.(type) {
 	case *parser.NumberLiteral:
-		return scan.NewNumberLiteralSelector(model.NewVectorPool(stepsBatch), opts, e.Val), nil
+		return scan.NewNumberLiteralSelector(model.NewVectorPool(stepsBatch, opts.MemoryTracker), opts, e.Val), nil
 
 	case *parser.VectorSelector:
 		start, end := getTimeRangesForVectorSelector(e, opts, 0)
 		hints.Start = start
 		hints.End = end
 		filter := storage.GetSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, hints)
-		return newShardedVectorSelector(filter, opts, e.Offset)
+		return newShardedVectorSelector(filter, opts, e.Offset, false)
 
 	case *logicalplan.FilteredSelector:
 		start, end := getTimeRangesForVectorSelector(e.VectorSelector, opts, 0)
 		hints.Start = start
 		hints.End = end
 		selector := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, e.Filters, hints)
-		return newShardedVectorSelector(selector, opts, e.Offset)
+		return newShardedVectorSelector(selector, opts, e.Offset, false)
 
 	case *parser.Call:
 		hints.Func = e.Func.Name
@@ -101,7 +113,41 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 				nextOperators[i] = next
 			}
 
-			return function.NewHistogramOperator(model.NewVectorPool(stepsBatch), e.Args, nextOperators, stepsBatch)
+			return function.NewHistogramOperator(model.NewVectorPool(stepsBatch, opts.MemoryTracker), e.Args, nextOperators, stepsBatch)
+		}
+
+		if e.Func.Name == "timestamp" {
+			next, ok, err := newTimestampSelector(e.Args[0], storage, opts, hints)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return next, nil
+			}
+		}
+
+		if e.Func.Name == "absent" || e.Func.Name == "absent_over_time" {
+			return newAbsentOperator(e, storage, opts, hints)
+		}
+
+		// Sorting only affects the order of instant query results, which
+		// is handled by the engine, so sort calls do not change the input.
+		if e.Func.Name == "sort" || e.Func.Name == "sort_desc" {
+			return newOperator(e.Args[0], storage, opts, hints)
+		}
+
+		if e.Func.Name == "label_replace" || e.Func.Name == "label_join" {
+			next, err := newOperator(e.Args[0], storage, opts, hints)
+			if err != nil {
+				return nil, err
+			}
+			return function.NewRelabelOperator(next, e)
+		}
+
+		if e.Func.Name == "holt_winters" {
+			if err := function.ValidateHoltWinters(e.Args); err != nil {
+				return nil, err
+			}
 		}
 
 		// TODO(saswatamcode): Tracked in https://github.com/thanos-community/promql-engine/issues/23
@@ -111,7 +157,7 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 			return nil, err
 		}
 
-		if e.Func.Variadic != 0 {
+		if _, ok := variadicFunctions[e.Func.Name]; e.Func.Variadic != 0 && !ok {
 			return nil, errors.Wrapf(parse.ErrNotImplemented, "got variadic function: %s", e)
 		}
 
@@ -123,33 +169,12 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 				if call == nil {
 					return nil, parse.ErrNotImplemented
 				}
-
-				vs, filters, err := unpackVectorSelector(t)
-				if err != nil {
-					return nil, err
-				}
-
-				start, end := getTimeRangesForVectorSelector(vs, opts, t.Range)
-				hints.Start = start
-				hints.End = end
-				hints.Range = t.Range.Milliseconds()
-				filter := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), vs.LabelMatchers, filters, hints)
-
-				numShards := runtime.GOMAXPROCS(0) / 2
-				if numShards < 1 {
-					numShards = 1
-				}
-
-				operators := make([]model.VectorOperator, 0, numShards)
-				for i := 0; i < numShards; i++ {
-					operator := exchange.NewConcurrent(
-						scan.NewMatrixSelector(model.NewVectorPool(stepsBatch), filter, call, e, opts, t.Range, vs.Offset, i, numShards),
-						2,
-					)
-					operators = append(operators, operator)
+				return newMatrixSelectorOperator(e, t, call, storage, opts, hints)
+			case *parser.SubqueryExpr:
+				if call == nil {
+					return nil, parse.ErrNotImplemented
 				}
-
-				return exchange.NewCoalesce(model.NewVectorPool(stepsBatch), operators...), nil
+				return newSubqueryOperator(e, t, call, storage, opts, hints)
 			}
 		}
 
@@ -176,6 +201,14 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 			return nil, err
 		}
 
+		if e.Op == parser.COUNT_VALUES {
+			param, err := parse.UnwrapString(e.Param)
+			if err != nil {
+				return nil, err
+			}
+			return exchange.NewConcurrent(instrument(aggregate.NewCountValues(model.NewVectorPool(stepsBatch, opts.MemoryTracker), next, param, !e.Without, e.Grouping, stepsBatch, opts), opts), 2), nil
+		}
+
 		if e.Param != nil {
 			paramOp, err = newOperator(e.Param, storage, opts, hints)
 			if err != nil {
@@ -184,16 +217,16 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		}
 
 		if e.Op == parser.TOPK || e.Op == parser.BOTTOMK {
-			next, err = aggregate.NewKHashAggregate(model.NewVectorPool(stepsBatch), next, paramOp, e.Op, !e.Without, e.Grouping, stepsBatch)
+			next, err = aggregate.NewKHashAggregate(model.NewVectorPool(stepsBatch, opts.MemoryTracker), next, paramOp, e.Op, !e.Without, e.Grouping, stepsBatch, opts)
 		} else {
-			next, err = aggregate.NewHashAggregate(model.NewVectorPool(stepsBatch), next, paramOp, e.Op, !e.Without, e.Grouping, stepsBatch)
+			next, err = aggregate.NewHashAggregate(model.NewVectorPool(stepsBatch, opts.MemoryTracker), next, paramOp, e.Op, !e.Without, e.Grouping, stepsBatch, opts)
 		}
 
 		if err != nil {
 			return nil, err
 		}
 
-		return exchange.NewConcurrent(next, 2), nil
+		return exchange.NewConcurrent(instrument(next, opts), 2), nil
 
 	case *parser.BinaryExpr:
 		if e.LHS.Type() == parser.ValueTypeScalar || e.RHS.Type() == parser.ValueTypeScalar {
@@ -218,7 +251,7 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		case parser.ADD:
 			return next, nil
 		case parser.SUB:
-			return unary.NewUnaryNegation(next, stepsBatch)
+			return unary.NewUnaryNegation(next, stepsBatch, opts.Parallelism)
 		default:
 			// This shouldn't happen as Op was validated when parsing already
 			// https://github.com/prometheus/prometheus/blob/v2.38.0/promql/parser/parse.go#L573.
@@ -228,13 +261,13 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 	case *parser.StepInvariantExpr:
 		switch t := e.Expr.(type) {
 		case *parser.NumberLiteral:
-			return scan.NewNumberLiteralSelector(model.NewVectorPool(stepsBatch), opts, t.Val), nil
+			return scan.NewNumberLiteralSelector(model.NewVectorPool(stepsBatch, opts.MemoryTracker), opts, t.Val), nil
 		}
 		next, err := newOperator(e.Expr, storage, opts.WithEndTime(opts.Start), hints)
 		if err != nil {
 			return nil, err
 		}
-		return step_invariant.NewStepInvariantOperator(model.NewVectorPool(stepsBatch), next, e.Expr, opts, stepsBatch)
+		return step_invariant.NewStepInvariantOperator(model.NewVectorPool(stepsBatch, opts.MemoryTracker), next, e.Expr, opts, stepsBatch)
 
 	case logicalplan.Coalesce:
 		operators := make([]model.VectorOperator, len(e.Expressions))
@@ -245,21 +278,227 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 			}
 			operators[i] = operator
 		}
-		return exchange.NewCoalesce(model.NewVectorPool(stepsBatch), operators...), nil
+		return exchange.NewCoalesce(model.NewVectorPool(stepsBatch, opts.MemoryTracker), opts.Parallelism, operators...), nil
+
+	case logicalplan.Deduplicate:
+		operators := make([]model.VectorOperator, len(e.Expressions))
+		for i, expr := range e.Expressions {
+			operator, err := newOperator(expr, storage, opts, hints)
+			if err != nil {
+				return nil, err
+			}
+			operators[i] = operator
+		}
+		coalesce := exchange.NewCoalesce(model.NewVectorPool(stepsBatch, opts.MemoryTracker), opts.Parallelism, operators...)
+		return exchange.NewDedup(model.NewVectorPool(stepsBatch, opts.MemoryTracker), coalesce, e.ReplicaLabels, opts), nil
 
 	case *logicalplan.RemoteExecution:
-		qry, err := e.Engine.NewRangeQuery(&promql.QueryOpts{}, e.Query, opts.Start, opts.End, opts.Step)
+		var (
+			qry promql.Query
+			err error
+		)
+		// Remote executions in subqueries are evaluated over the range of the subquery,
+		// so only the options in effect here tell if a single timestamp is evaluated.
+		if opts.IsInstantQuery() {
+			qry, err = e.Engine.NewInstantQuery(&promql.QueryOpts{}, e.Query, opts.Start)
+		} else {
+			qry, err = e.Engine.NewRangeQuery(&promql.QueryOpts{}, e.Query, opts.Start, opts.End, opts.Step)
+		}
 		if err != nil {
-			return nil, err
+			if !opts.EnablePartialResponse {
+				return nil, err
+			}
+			// The remote engine does not contribute to the result, which is the same as
+			// merging the outputs of no operators.
+			opts.Warnings.Add(errors.Wrapf(err, "creating remote query %s", e.Query))
+			return exchange.NewCoalesce(model.NewVectorPool(stepsBatch, opts.MemoryTracker), opts.Parallelism), nil
 		}
 
-		return exchange.NewConcurrent(remote.NewExecution(qry, model.NewVectorPool(stepsBatch), opts), 2), nil
+		return exchange.NewConcurrent(instrument(remote.NewExecution(qry, model.NewVectorPool(stepsBatch, opts.MemoryTracker), opts), opts), 2), nil
 
 	default:
 		return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e)
 	}
 }
 
+// variadicFunctions are the functions with a variable number of arguments whose
+// optional arguments are supported. label_join has its own operator.
+var variadicFunctions = map[string]struct{}{
+	"round":         {},
+	"days_in_month": {},
+	"day_of_month":  {},
+	"day_of_week":   {},
+	"day_of_year":   {},
+	"hour":          {},
+	"minute":        {},
+	"month":         {},
+	"year":          {},
+}
+
+func newMatrixSelectorOperator(funcExpr *parser.Call, t *parser.MatrixSelector, call function.FunctionCall, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	vs, filters, err := unpackVectorSelector(t)
+	if err != nil {
+		return nil, err
+	}
+
+	argHints := hints
+	start, end := getTimeRangesForVectorSelector(vs, opts, t.Range)
+	hints.Start = start
+	hints.End = end
+	hints.Range = t.Range.Milliseconds()
+	filter := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), vs.LabelMatchers, filters, hints)
+
+	numShards := getNumShards(opts)
+
+	operators := make([]model.VectorOperator, 0, numShards)
+	for i := 0; i < numShards; i++ {
+		// Each shard consumes its own copy of the scalar arguments.
+		scalarArgs, err := newScalarArgOperators(funcExpr, storage, opts, argHints)
+		if err != nil {
+			return nil, err
+		}
+		operator := exchange.NewConcurrent(
+			instrument(scan.NewMatrixSelector(model.NewVectorPool(stepsBatch, opts.MemoryTracker), filter, call, funcExpr, scalarArgs, opts, t.Range, vs.Offset, i, numShards), opts),
+			2,
+		)
+		operators = append(operators, instrument(operator, opts))
+	}
+
+	return exchange.NewCoalesce(model.NewVectorPool(stepsBatch, opts.MemoryTracker), opts.Parallelism, operators...), nil
+}
+
+func newAbsentOperator(e *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	var (
+		next model.VectorOperator
+		err  error
+	)
+	switch t := e.Args[0].(type) {
+	case *parser.MatrixSelector:
+		// absent_over_time returns a sample for each step in which present_over_time does not.
+		next, err = newMatrixSelectorOperator(e, t, function.Funcs["present_over_time"], storage, opts, hints)
+	case *parser.SubqueryExpr:
+		next, err = newSubqueryOperator(e, t, function.Funcs["present_over_time"], storage, opts, hints)
+	default:
+		next, err = newOperator(t, storage, opts, hints)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Output labels are only derived from selectors, like in Prometheus.
+	var matchers []*labels.Matcher
+	switch t := e.Args[0].(type) {
+	case *parser.VectorSelector:
+		matchers = t.LabelMatchers
+	case *logicalplan.FilteredSelector:
+		matchers = append(append([]*labels.Matcher{}, t.LabelMatchers...), t.Filters...)
+	case *parser.MatrixSelector:
+		vs, filters, err := unpackVectorSelector(t)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(append([]*labels.Matcher{}, vs.LabelMatchers...), filters...)
+	}
+
+	return function.NewAbsentOperator(model.NewVectorPool(stepsBatch, opts.MemoryTracker), next, e, matchers, opts), nil
+}
+
+func newSubqueryOperator(funcExpr *parser.Call, e *parser.SubqueryExpr, call function.FunctionCall, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	step := e.Step
+	if step == 0 {
+		if opts.NoStepSubqueryIntervalFn == nil {
+			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got subquery without step: %s", e)
+		}
+		step = opts.NoStepSubqueryIntervalFn(e.Range)
+	}
+
+	// Start with the first timestamp after (start - offset - range)
+	// that is aligned with the step (multiple of 'step').
+	// Copy from https://github.com/prometheus/prometheus/blob/v0.40.1/promql/engine.go#L1628.
+	offset := e.Offset.Milliseconds()
+	rangeMillis := e.Range.Milliseconds()
+	stepMillis := step.Milliseconds()
+	start := stepMillis * ((opts.Start.UnixMilli() - offset - rangeMillis) / stepMillis)
+	if start < (opts.Start.UnixMilli() - offset - rangeMillis) {
+		start += stepMillis
+	}
+	if start != opts.Start.UnixMilli() {
+		// Adjust the offset of selectors based on the new
+		// start time of the subquery since the calculation
+		// of the offset with @ happens w.r.t. the start time.
+		logicalplan.SetOffsetForAtModifier(start, e.Expr)
+	}
+
+	// The inner operator shares all options of the query except for its time range and resolution.
+	subqueryOpts := *opts
+	subqueryOpts.Start = time.UnixMilli(start)
+	subqueryOpts.End = time.UnixMilli(opts.End.UnixMilli() - offset)
+	subqueryOpts.Step = step
+	hints.Step = stepMillis
+
+	inner, err := newOperator(e.Expr, storage, &subqueryOpts, hints)
+	if err != nil {
+		return nil, err
+	}
+
+	scalarArgs, err := newScalarArgOperators(funcExpr, storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+
+	return scan.NewSubqueryOperator(model.NewVectorPool(stepsBatch, opts.MemoryTracker), inner, call, funcExpr, e, scalarArgs, opts), nil
+}
+
+// newScalarArgOperators creates operators for the scalar arguments of a range function,
+// like the quantile in quantile_over_time.
+func newScalarArgOperators(funcExpr *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) ([]model.VectorOperator, error) {
+	var scalarArgs []model.VectorOperator
+	for _, arg := range funcExpr.Args {
+		if arg.Type() != parser.ValueTypeScalar {
+			continue
+		}
+		op, err := newOperator(arg, storage, opts, hints)
+		if err != nil {
+			return nil, err
+		}
+		scalarArgs = append(scalarArgs, op)
+	}
+	return scalarArgs, nil
+}
+
+// newTimestampSelector creates a vector selector which returns the timestamps of samples
+// instead of their values when the argument of timestamp is a vector selector.
+// The returned bool is false for other arguments.
+func newTimestampSelector(expr parser.Expr, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, bool, error) {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return newTimestampSelector(e.Expr, storage, opts, hints)
+	case *parser.StepInvariantExpr:
+		next, ok, err := newTimestampSelector(e.Expr, storage, opts.WithEndTime(opts.Start), hints)
+		if err != nil || !ok {
+			return nil, ok, err
+		}
+		op, err := step_invariant.NewStepInvariantOperator(model.NewVectorPool(stepsBatch, opts.MemoryTracker), next, e.Expr, opts, stepsBatch)
+		return op, true, err
+	case *parser.VectorSelector:
+		start, end := getTimeRangesForVectorSelector(e, opts, 0)
+		hints.Start = start
+		hints.End = end
+		filter := storage.GetSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, hints)
+		op, err := newShardedVectorSelector(filter, opts, e.Offset, true)
+		return op, true, err
+	case *logicalplan.FilteredSelector:
+		start, end := getTimeRangesForVectorSelector(e.VectorSelector, opts, 0)
+		hints.Start = start
+		hints.End = end
+		selector := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, e.Filters, hints)
+		op, err := newShardedVectorSelector(selector, opts, e.Offset, true)
+		return op, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
 func unpackVectorSelector(t *parser.MatrixSelector) (*parser.VectorSelector, []*labels.Matcher, error) {
 	switch t := t.VectorSelector.(type) {
 	case *parser.VectorSelector:
@@ -271,20 +510,17 @@ func unpackVectorSelector(t *parser.MatrixSelector) (*parser.VectorSelector, []*
 	}
 }
 
-func newShardedVectorSelector(selector engstore.SeriesSelector, opts *query.Options, offset time.Duration) (model.VectorOperator, error) {
-	numShards := runtime.GOMAXPROCS(0) / 2
-	if numShards < 1 {
-		numShards = 1
-	}
+func newShardedVectorSelector(selector engstore.SeriesSelector, opts *query.Options, offset time.Duration, selectTimestamp bool) (model.VectorOperator, error) {
+	numShards := getNumShards(opts)
 	operators := make([]model.VectorOperator, 0, numShards)
 	for i := 0; i < numShards; i++ {
 		operator := exchange.NewConcurrent(
-			scan.NewVectorSelector(
-				model.NewVectorPool(stepsBatch), selector, opts, offset, i, numShards), 2)
-		operators = append(operators, operator)
+			instrument(scan.NewVectorSelector(
+				model.NewVectorPool(stepsBatch, opts.MemoryTracker), selector, opts, offset, i, numShards, selectTimestamp), opts), 2)
+		operators = append(operators, instrument(operator, opts))
 	}
 
-	return exchange.NewCoalesce(model.NewVectorPool(stepsBatch), operators...), nil
+	return exchange.NewCoalesce(model.NewVectorPool(stepsBatch, opts.MemoryTracker), opts.Parallelism, operators...), nil
 }
 
 func newVectorBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
@@ -296,7 +532,7 @@ func newVectorBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.Select
 	if err != nil {
 		return nil, err
 	}
-	return binary.NewVectorOperator(model.NewVectorPool(stepsBatch), leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool)
+	return binary.NewVectorOperator(model.NewVectorPool(stepsBatch, opts.MemoryTracker), leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool, opts)
 }
 
 func newScalarBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
@@ -317,7 +553,15 @@ func newScalarBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.Select
 		scalarSide = binary.ScalarSideLeft
 	}
 
-	return binary.NewScalar(model.NewVectorPool(stepsBatch), lhs, rhs, e.Op, scalarSide, e.ReturnBool)
+	return binary.NewScalar(model.NewVectorPool(stepsBatch, opts.MemoryTracker), lhs, rhs, e.Op, scalarSide, e.ReturnBool, opts)
+}
+
+// getNumShards returns the number of shards into which selectors are split.
+func getNumShards(opts *query.Options) int {
+	if opts.Parallelism < 1 {
+		return 1
+	}
+	return opts.Parallelism
 }
 
 // Copy from https://github.com/prometheus/prometheus/blob/v2.39.1/promql/engine.go#L791.
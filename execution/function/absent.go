@@ -0,0 +1,137 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// absentOperator implements absent and absent_over_time. It returns a single series
+// which has a sample with the value 1 for each step in which the next operator
+// has no samples.
+type absentOperator struct {
+	pool     *model.VectorPool
+	next     model.VectorOperator
+	funcExpr *parser.Call
+	series   []labels.Labels
+
+	mint        int64
+	maxt        int64
+	step        int64
+	currentStep int64
+	stepsBatch  int
+
+	// present tracks which steps of the current batch have samples.
+	present []bool
+}
+
+// NewAbsentOperator creates an operator for absent and absent_over_time. The labels of
+// the output series are derived from the given matchers of the function argument.
+func NewAbsentOperator(pool *model.VectorPool, next model.VectorOperator, funcExpr *parser.Call, matchers []*labels.Matcher, opts *query.Options) model.VectorOperator {
+	step := opts.Step.Milliseconds()
+	// We set step to be at least 1.
+	if step == 0 {
+		step = 1
+	}
+	pool.SetStepSize(1)
+	return &absentOperator{
+		pool:        pool,
+		next:        next,
+		funcExpr:    funcExpr,
+		series:      []labels.Labels{createLabelsForAbsentFunction(matchers)},
+		mint:        opts.Start.UnixMilli(),
+		maxt:        opts.End.UnixMilli(),
+		step:        step,
+		currentStep: opts.Start.UnixMilli(),
+		stepsBatch:  int(opts.StepsBatch),
+		present:     make([]bool, opts.StepsBatch),
+	}
+}
+
+func (o *absentOperator) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*absentOperator] %v(%v)", o.funcExpr.Func.Name, o.funcExpr.Args), []model.VectorOperator{o.next}
+}
+
+func (o *absentOperator) Series(_ context.Context) ([]labels.Labels, error) {
+	return o.series, nil
+}
+
+func (o *absentOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *absentOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	if o.currentStep > o.maxt {
+		return nil, nil
+	}
+
+	in, err := o.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range o.present {
+		o.present[i] = false
+	}
+	for _, vector := range in {
+		if len(vector.SampleIDs) > 0 || len(vector.HistogramIDs) > 0 {
+			if i := (vector.T - o.currentStep) / o.step; i >= 0 && i < int64(len(o.present)) {
+				o.present[i] = true
+			}
+		}
+		o.next.GetPool().PutStepVector(vector)
+	}
+	if in != nil {
+		o.next.GetPool().PutVectors(in)
+	}
+
+	out := o.pool.GetVectorBatch()
+	for i := 0; i < o.stepsBatch && o.currentStep <= o.maxt; i++ {
+		sv := o.pool.GetStepVector(o.currentStep)
+		if !o.present[i] {
+			sv.SampleIDs = append(sv.SampleIDs, 0)
+			sv.Samples = append(sv.Samples, 1)
+		}
+		out = append(out, sv)
+		o.currentStep += o.step
+	}
+	return out, nil
+}
+
+// createLabelsForAbsentFunction returns the labels that are uniquely and exactly matched
+// in the given matchers.
+// Copy from https://github.com/prometheus/prometheus/blob/v0.40.1/promql/functions.go#L1385.
+func createLabelsForAbsentFunction(matchers []*labels.Matcher) labels.Labels {
+	m := labels.Labels{}
+
+	empty := []string{}
+	for _, ma := range matchers {
+		if ma.Name == labels.MetricName {
+			continue
+		}
+		if ma.Type == labels.MatchEqual && !m.Has(ma.Name) {
+			m = labels.NewBuilder(m).Set(ma.Name, ma.Value).Labels(nil)
+		} else {
+			empty = append(empty, ma.Name)
+		}
+	}
+
+	for _, v := range empty {
+		m = labels.NewBuilder(m).Del(v).Labels(nil)
+	}
+	return m
+}
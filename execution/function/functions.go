@@ -6,8 +6,10 @@ package function
 import (
 	"fmt"
 	"math"
+	"time"
 
 	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
@@ -24,6 +26,9 @@ type FunctionArgs struct {
 	SelectRange  int64
 	ScalarPoints []float64
 	Offset       int64
+	// ValuesBuffer is a buffer of the calling operator which range functions can
+	// reuse between steps for the values of Points. It can be nil.
+	ValuesBuffer *[]float64
 }
 
 // FunctionCall represents functions as defined in https://prometheus.io/docs/prometheus/latest/querying/functions/
@@ -45,6 +50,25 @@ func simpleFunc(f func(float64) float64) FunctionCall {
 
 }
 
+// dateFunc creates a FunctionCall for calendar functions. The input sample is
+// interpreted as a Unix timestamp in seconds. Without an input sample, which is the
+// case for the zero-argument forms of these functions, the step time is used instead.
+func dateFunc(f func(time.Time) float64) FunctionCall {
+	return func(fa FunctionArgs) promql.Sample {
+		t := time.Unix(fa.StepTime/1000, 0).UTC()
+		if len(fa.Points) > 0 {
+			t = time.Unix(int64(fa.Points[0].V), 0).UTC()
+		}
+		return promql.Sample{
+			Metric: fa.Labels,
+			Point: promql.Point{
+				T: fa.StepTime,
+				V: f(t),
+			},
+		}
+	}
+}
+
 var Funcs = map[string]FunctionCall{
 	"abs":   simpleFunc(math.Abs),
 	"ceil":  simpleFunc(math.Ceil),
@@ -72,11 +96,46 @@ var Funcs = map[string]FunctionCall{
 	"deg": simpleFunc(func(v float64) float64 {
 		return v * 180 / math.Pi
 	}),
+	"sgn": simpleFunc(func(v float64) float64 {
+		if v < 0 {
+			return -1
+		} else if v > 0 {
+			return 1
+		}
+		return v
+	}),
+	"round": func(f FunctionArgs) promql.Sample {
+		if len(f.Points) == 0 {
+			return InvalidSample
+		}
+		// round returns a number rounded to toNearest.
+		// Ties are solved by rounding up.
+		toNearest := float64(1)
+		if len(f.ScalarPoints) > 0 {
+			toNearest = f.ScalarPoints[0]
+		}
+		// Invert as it seems to cause fewer floating point accuracy issues.
+		toNearestInverse := 1.0 / toNearest
+		return promql.Sample{
+			Metric: f.Labels,
+			Point: promql.Point{
+				T: f.StepTime,
+				V: math.Floor(f.Points[0].V*toNearestInverse+0.5) / toNearestInverse,
+			},
+		}
+	},
+	// timestamp of a vector selector is evaluated by the selector itself, since it
+	// returns the timestamps of the selected samples. For other expressions, samples
+	// always have the timestamp of the step.
 	"timestamp": func(f FunctionArgs) promql.Sample {
+		if len(f.Points) == 0 {
+			return InvalidSample
+		}
 		return promql.Sample{
+			Metric: f.Labels,
 			Point: promql.Point{
 				T: f.StepTime,
-				V: float64(f.Points[0].T) / 1000,
+				V: float64(f.StepTime) / 1000,
 			},
 		}
 	},
@@ -160,6 +219,18 @@ var Funcs = map[string]FunctionCall{
 			},
 		}
 	},
+	"quantile_over_time": func(f FunctionArgs) promql.Sample {
+		if len(f.Points) == 0 || len(f.ScalarPoints) == 0 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			Point: promql.Point{
+				T: f.StepTime,
+				V: quantileOverTime(f.ScalarPoints[0], f.Points, f.ValuesBuffer),
+			},
+		}
+	},
 	"count_over_time": func(f FunctionArgs) promql.Sample {
 		if len(f.Points) == 0 {
 			return InvalidSample
@@ -240,6 +311,34 @@ var Funcs = map[string]FunctionCall{
 			},
 		}
 	},
+	"predict_linear": func(f FunctionArgs) promql.Sample {
+		if len(f.Points) < 2 || len(f.ScalarPoints) == 0 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			Point: promql.Point{
+				T: f.StepTime,
+				V: predictLinear(f.Points, f.ScalarPoints[0], f.StepTime),
+			},
+		}
+	},
+	"holt_winters": func(f FunctionArgs) promql.Sample {
+		if len(f.Points) < 2 || len(f.ScalarPoints) < 2 {
+			return InvalidSample
+		}
+		sf, tf := f.ScalarPoints[0], f.ScalarPoints[1]
+		if !validHoltWintersFactor(sf) || !validHoltWintersFactor(tf) {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			Point: promql.Point{
+				T: f.StepTime,
+				V: holtWinters(f.Points, sf, tf),
+			},
+		}
+	},
 	"irate": func(f FunctionArgs) promql.Sample {
 		if len(f.Points) < 2 {
 			return InvalidSample
@@ -292,11 +391,16 @@ var Funcs = map[string]FunctionCall{
 		if len(f.Points) < 2 {
 			return InvalidSample
 		}
+		v, h, ok := extrapolatedRate(f.Points, true, true, f.StepTime, f.SelectRange, f.Offset)
+		if !ok {
+			return InvalidSample
+		}
 		return promql.Sample{
 			Metric: f.Labels,
 			Point: promql.Point{
 				T: f.StepTime,
-				V: extrapolatedRate(f.Points, true, true, f.StepTime, f.SelectRange, f.Offset),
+				V: v,
+				H: h,
 			},
 		}
 	},
@@ -304,11 +408,16 @@ var Funcs = map[string]FunctionCall{
 		if len(f.Points) < 2 {
 			return InvalidSample
 		}
+		v, h, ok := extrapolatedRate(f.Points, false, false, f.StepTime, f.SelectRange, f.Offset)
+		if !ok {
+			return InvalidSample
+		}
 		return promql.Sample{
 			Metric: f.Labels,
 			Point: promql.Point{
 				T: f.StepTime,
-				V: extrapolatedRate(f.Points, false, false, f.StepTime, f.SelectRange, f.Offset),
+				V: v,
+				H: h,
 			},
 		}
 	},
@@ -316,11 +425,16 @@ var Funcs = map[string]FunctionCall{
 		if len(f.Points) < 2 {
 			return InvalidSample
 		}
+		v, h, ok := extrapolatedRate(f.Points, true, false, f.StepTime, f.SelectRange, f.Offset)
+		if !ok {
+			return InvalidSample
+		}
 		return promql.Sample{
 			Metric: f.Labels,
 			Point: promql.Point{
 				T: f.StepTime,
-				V: extrapolatedRate(f.Points, true, false, f.StepTime, f.SelectRange, f.Offset),
+				V: v,
+				H: h,
 			},
 		}
 	},
@@ -377,6 +491,74 @@ var Funcs = map[string]FunctionCall{
 			},
 		}
 	},
+	"days_in_month": dateFunc(func(t time.Time) float64 {
+		return float64(32 - time.Date(t.Year(), t.Month(), 32, 0, 0, 0, 0, time.UTC).Day())
+	}),
+	"day_of_month": dateFunc(func(t time.Time) float64 {
+		return float64(t.Day())
+	}),
+	"day_of_week": dateFunc(func(t time.Time) float64 {
+		return float64(t.Weekday())
+	}),
+	"day_of_year": dateFunc(func(t time.Time) float64 {
+		return float64(t.YearDay())
+	}),
+	"hour": dateFunc(func(t time.Time) float64 {
+		return float64(t.Hour())
+	}),
+	"minute": dateFunc(func(t time.Time) float64 {
+		return float64(t.Minute())
+	}),
+	"month": dateFunc(func(t time.Time) float64 {
+		return float64(t.Month())
+	}),
+	"year": dateFunc(func(t time.Time) float64 {
+		return float64(t.Year())
+	}),
+	"histogram_count": func(f FunctionArgs) promql.Sample {
+		if len(f.Points) == 0 || f.Points[0].H == nil {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			Point: promql.Point{
+				T: f.StepTime,
+				V: f.Points[0].H.Count,
+			},
+		}
+	},
+	"histogram_sum": func(f FunctionArgs) promql.Sample {
+		if len(f.Points) == 0 || f.Points[0].H == nil {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			Point: promql.Point{
+				T: f.StepTime,
+				V: f.Points[0].H.Sum,
+			},
+		}
+	},
+	"histogram_fraction": func(f FunctionArgs) promql.Sample {
+		if len(f.Points) == 0 || f.Points[0].H == nil || len(f.ScalarPoints) < 2 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			Point: promql.Point{
+				T: f.StepTime,
+				V: histogramFraction(f.ScalarPoints[0], f.ScalarPoints[1], f.Points[0].H),
+			},
+		}
+	},
+}
+
+// histogramFuncs are functions which take native histograms as input.
+// Float samples are not passed to them.
+var histogramFuncs = map[string]struct{}{
+	"histogram_count":    {},
+	"histogram_sum":      {},
+	"histogram_fraction": {},
 }
 
 func NewFunctionCall(f *parser.Function) (FunctionCall, error) {
@@ -392,21 +574,64 @@ func NewFunctionCall(f *parser.Function) (FunctionCall, error) {
 	return nil, errors.Wrap(parse.ErrNotSupportedExpr, msg)
 }
 
+// ValidateHoltWinters checks that the smoothing and trend factors of a holt_winters call are literals.
+// Since function calls cannot fail, only literal factors are supported. Their values are checked
+// by CheckScalarArgs once the function is evaluated, which is when Prometheus rejects them.
+func ValidateHoltWinters(args parser.Expressions) error {
+	for _, arg := range args[1:] {
+		if _, err := parse.UnwrapFloat(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckScalarArgs returns an error if the scalar arguments of a range function are invalid.
+// Operators call it before they evaluate the function for a series with points in its range.
+func CheckScalarArgs(funcExpr *parser.Call, scalarPoints []float64) error {
+	if funcExpr.Func.Name != "holt_winters" {
+		return nil
+	}
+	if sf := scalarPoints[0]; !validHoltWintersFactor(sf) {
+		return errors.Newf("invalid smoothing factor. Expected: 0 < sf < 1, got: %f", sf)
+	}
+	if tf := scalarPoints[1]; !validHoltWintersFactor(tf) {
+		return errors.Newf("invalid trend factor. Expected: 0 < tf < 1, got: %f", tf)
+	}
+	return nil
+}
+
+func validHoltWintersFactor(f float64) bool {
+	return f > 0 && f < 1
+}
+
 // extrapolatedRate is a utility function for rate/increase/delta.
 // It calculates the rate (allowing for counter resets if isCounter is true),
 // extrapolates if the first/last sample is close to the boundary, and returns
 // the result as either per-second (if isRate is true) or overall.
-func extrapolatedRate(samples []promql.Point, isCounter, isRate bool, stepTime int64, selectRange int64, offset int64) float64 {
+// The returned bool is false if the range contains a mix of floats and histograms,
+// or if the histograms are not compatible with each other.
+func extrapolatedRate(samples []promql.Point, isCounter, isRate bool, stepTime int64, selectRange int64, offset int64) (float64, *histogram.FloatHistogram, bool) {
 	var (
-		rangeStart = stepTime - (selectRange + offset)
-		rangeEnd   = stepTime - offset
+		rangeStart      = stepTime - (selectRange + offset)
+		rangeEnd        = stepTime - offset
+		resultValue     float64
+		resultHistogram *histogram.FloatHistogram
 	)
 
-	resultValue := samples[len(samples)-1].V - samples[0].V
-	if isCounter {
+	if samples[0].H != nil {
+		resultHistogram = histogramRate(samples, isCounter)
+		if resultHistogram == nil {
+			return 0, nil, false
+		}
+	} else {
+		resultValue = samples[len(samples)-1].V - samples[0].V
 		var lastValue float64
 		for _, sample := range samples {
-			if sample.V < lastValue {
+			if sample.H != nil {
+				return 0, nil, false
+			}
+			if isCounter && sample.V < lastValue {
 				resultValue += lastValue
 			}
 			lastValue = sample.V
@@ -455,9 +680,60 @@ func extrapolatedRate(samples []promql.Point, isCounter, isRate bool, stepTime i
 	if isRate {
 		factor /= float64(selectRange / 1000)
 	}
-	resultValue *= factor
+	if resultHistogram == nil {
+		resultValue *= factor
+	} else {
+		resultHistogram.Scale(factor)
+	}
 
-	return resultValue
+	return resultValue, resultHistogram, true
+}
+
+// histogramRate is a helper function for extrapolatedRate. It requires
+// points[0] to be a histogram. It returns nil if any other Point in points is
+// not a histogram.
+// Copy from https://github.com/prometheus/prometheus/blob/v0.40.1/promql/functions.go#L169.
+func histogramRate(points []promql.Point, isCounter bool) *histogram.FloatHistogram {
+	prev := points[0].H // We already know that this is a histogram.
+	last := points[len(points)-1].H
+	if last == nil {
+		return nil // Range contains a mix of histograms and floats.
+	}
+	minSchema := prev.Schema
+	if last.Schema < minSchema {
+		minSchema = last.Schema
+	}
+
+	// First iteration to find out two things:
+	// - What's the smallest relevant schema?
+	// - Are all data points histograms?
+	for _, currPoint := range points[1 : len(points)-1] {
+		curr := currPoint.H
+		if curr == nil {
+			return nil // Range contains a mix of histograms and floats.
+		}
+		if !isCounter {
+			continue
+		}
+		if curr.Schema < minSchema {
+			minSchema = curr.Schema
+		}
+	}
+
+	h := last.CopyToSchema(minSchema)
+	h.Sub(prev)
+
+	if isCounter {
+		// Second iteration to deal with counter resets.
+		for _, currPoint := range points[1:] {
+			curr := currPoint.H
+			if curr.DetectReset(prev) {
+				h.Add(prev)
+			}
+			prev = curr
+		}
+	}
+	return h.Compact(0)
 }
 
 func instantValue(samples []promql.Point, isRate bool) (float64, bool) {
@@ -577,6 +853,21 @@ func stdvarOverTime(points []promql.Point) float64 {
 	return (aux + cAux) / count
 }
 
+func quantileOverTime(q float64, points []promql.Point, buf *[]float64) float64 {
+	// Points are reused between steps, so their values are copied before they are sorted.
+	var values []float64
+	if buf != nil {
+		values = (*buf)[:0]
+	}
+	for _, v := range points {
+		values = append(values, v.V)
+	}
+	if buf != nil {
+		*buf = values
+	}
+	return Quantile(q, values)
+}
+
 func changes(points []promql.Point) float64 {
 	var count float64
 	prev := points[0].V
@@ -599,6 +890,52 @@ func deriv(points []promql.Point) float64 {
 	return slope
 }
 
+func predictLinear(points []promql.Point, duration float64, stepTime int64) float64 {
+	slope, intercept := linearRegression(points, stepTime)
+	return slope*duration + intercept
+}
+
+// holtWinters calculates the double exponential smoothing of the points with the
+// smoothing factor sf and the trend factor tf.
+// Copy from https://github.com/prometheus/prometheus/blob/v0.40.1/promql/functions.go#L296.
+func holtWinters(points []promql.Point, sf, tf float64) float64 {
+	var s0, s1, b float64
+	// Set initial values.
+	s1 = points[0].V
+	b = points[1].V - points[0].V
+
+	// Run the smoothing operation.
+	var x, y float64
+	for i := 1; i < len(points); i++ {
+		// Scale the raw value against the smoothing factor.
+		x = sf * points[i].V
+
+		// Scale the last smoothed value with the trend at this point.
+		b = calcTrendValue(i-1, tf, s0, s1, b)
+		y = (1 - sf) * (s1 + b)
+
+		s0, s1 = s1, x+y
+	}
+	return s1
+}
+
+// calcTrendValue calculates the trend value at the given index i in raw data d.
+// This is somewhat analogous to the slope of the trend at the given index.
+// The argument "tf" is the trend factor.
+// The argument "s0" is the computed smoothed value.
+// The argument "s1" is the computed trend factor.
+// The argument "b" is the raw input value.
+func calcTrendValue(i int, tf, s0, s1, b float64) float64 {
+	if i == 0 {
+		return b
+	}
+
+	x := tf * (s1 - s0)
+	y := (1 - tf) * b
+
+	return x + y
+}
+
 func resets(points []promql.Point) float64 {
 	count := 0
 	prev := points[0].V
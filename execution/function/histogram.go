@@ -41,6 +41,11 @@ type histogramOperator struct {
 	// If outputIndex[i] is nil then series[i] has no valid `le` label.
 	outputIndex []*histogramSeries
 
+	// nativeOutputIndex is a mapping from input series ID to the output series ID
+	// for series which can contain native histograms, i.e. series without an `le` label.
+	// If nativeOutputIndex[i] is -1 then series[i] has an `le` label.
+	nativeOutputIndex []int
+
 	// seriesBuckets are the buckets for each individual series.
 	seriesBuckets []buckets
 }
@@ -133,6 +138,25 @@ func (o *histogramOperator) processInputSeries(vectors []model.StepVector) ([]mo
 		}
 
 		step := o.pool.GetStepVector(vector.T)
+		for i, seriesID := range vector.HistogramIDs {
+			outputSeriesID := o.nativeOutputIndex[seriesID]
+			if outputSeriesID < 0 {
+				continue
+			}
+			// At this step we have both conventional buckets and a native histogram
+			// for the same output series, so we do not evaluate anything.
+			if len(o.seriesBuckets[outputSeriesID]) > 0 {
+				o.seriesBuckets[outputSeriesID] = o.seriesBuckets[outputSeriesID][:0]
+				continue
+			}
+
+			q := math.NaN()
+			if stepIndex < len(o.scalarPoints) {
+				q = o.scalarPoints[stepIndex]
+			}
+			step.SampleIDs = append(step.SampleIDs, uint64(outputSeriesID))
+			step.Samples = append(step.Samples, histogramQuantile(q, vector.Histograms[i]))
+		}
 		for i, stepBuckets := range o.seriesBuckets {
 			// It could be zero if multiple input series map to the same output series ID.
 			if len(stepBuckets) == 0 {
@@ -172,19 +196,13 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 
 	o.series = make([]labels.Labels, 0)
 	o.outputIndex = make([]*histogramSeries, len(series))
+	o.nativeOutputIndex = make([]int, len(series))
 
-	for i, s := range series {
-		lbls, bucketLabel := dropLabel(s.Copy(), "le")
-		value, err := strconv.ParseFloat(bucketLabel.Value, 64)
-		if err != nil {
-			continue
-		}
-		lbls, _ = DropMetricName(lbls)
-
+	outputSeriesID := func(lbls labels.Labels) (int, error) {
 		hasher.Reset()
 		hashBuf = lbls.Bytes(hashBuf)
 		if _, err := hasher.Write(hashBuf); err != nil {
-			return err
+			return 0, err
 		}
 
 		seriesHash := hasher.Sum64()
@@ -194,6 +212,33 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 			seriesID = len(o.series) - 1
 			seriesHashes[seriesHash] = seriesID
 		}
+		return seriesID, nil
+	}
+
+	for i, s := range series {
+		o.nativeOutputIndex[i] = -1
+		lbls, bucketLabel := dropLabel(s.Copy(), "le")
+		if bucketLabel.Name == "" {
+			// Series without an `le` label can only be evaluated as native histograms.
+			lbls, _ = DropMetricName(lbls)
+			seriesID, err := outputSeriesID(lbls)
+			if err != nil {
+				return err
+			}
+			o.nativeOutputIndex[i] = seriesID
+			continue
+		}
+
+		value, err := strconv.ParseFloat(bucketLabel.Value, 64)
+		if err != nil {
+			continue
+		}
+		lbls, _ = DropMetricName(lbls)
+
+		seriesID, err := outputSeriesID(lbls)
+		if err != nil {
+			return err
+		}
 
 		o.outputIndex[i] = &histogramSeries{
 			outputID:   seriesID,
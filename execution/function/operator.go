@@ -42,6 +42,11 @@ type noArgFunctionOperator struct {
 	funcExpr    *parser.Call
 	call        FunctionCall
 	vectorPool  *model.VectorPool
+
+	// series and sampleIDs are empty for functions returning a scalar, and hold
+	// a single series without labels for functions returning a vector.
+	series    []labels.Labels
+	sampleIDs []uint64
 }
 
 func (o *noArgFunctionOperator) Explain() (me string, next []model.VectorOperator) {
@@ -49,7 +54,7 @@ func (o *noArgFunctionOperator) Explain() (me string, next []model.VectorOperato
 }
 
 func (o *noArgFunctionOperator) Series(ctx context.Context) ([]labels.Labels, error) {
-	return []labels.Labels{}, nil
+	return o.series, nil
 }
 
 func (o *noArgFunctionOperator) GetPool() *model.VectorPool {
@@ -67,8 +72,8 @@ func (o *noArgFunctionOperator) Next(ctx context.Context) ([]model.StepVector, e
 			StepTime: o.currentStep,
 		})
 		sv.T = o.currentStep
-		sv.Samples = []float64{result.V}
-		sv.SampleIDs = []uint64{}
+		sv.Samples = append(sv.Samples, result.V)
+		sv.SampleIDs = append(sv.SampleIDs, o.sampleIDs...)
 
 		ret = append(ret, sv)
 		o.currentStep += o.step
@@ -86,7 +91,7 @@ func NewFunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []mod
 			interval = 1
 		}
 
-		return &noArgFunctionOperator{
+		op := &noArgFunctionOperator{
 			currentStep: opts.Start.UnixMilli(),
 			mint:        opts.Start.UnixMilli(),
 			maxt:        opts.End.UnixMilli(),
@@ -94,8 +99,16 @@ func NewFunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []mod
 			stepsBatch:  stepsBatch,
 			funcExpr:    funcExpr,
 			call:        call,
-			vectorPool:  model.NewVectorPool(stepsBatch),
-		}, nil
+			vectorPool:  model.NewVectorPool(stepsBatch, opts.MemoryTracker),
+			series:      []labels.Labels{},
+			sampleIDs:   []uint64{},
+		}
+		// Zero-argument forms of vector functions, like day_of_month(), return a single series without labels.
+		if funcExpr.Type() == parser.ValueTypeVector {
+			op.series = []labels.Labels{{}}
+			op.sampleIDs = []uint64{0}
+		}
+		return op, nil
 	}
 	scalarPoints := make([][]float64, stepsBatch)
 	for i := 0; i < stepsBatch; i++ {
@@ -202,6 +215,17 @@ func (o *functionOperator) Next(ctx context.Context) ([]model.StepVector, error)
 			continue
 		}
 
+		if _, ok := histogramFuncs[o.funcExpr.Func.Name]; ok {
+			vectors[batchIndex] = o.callHistograms(vector, o.scalarPoints[batchIndex])
+			continue
+		}
+
+		// Functions which do not support native histograms produce no output for them.
+		if vector.Histograms != nil {
+			vectors[batchIndex].HistogramIDs = vector.HistogramIDs[:0]
+			vectors[batchIndex].Histograms = vector.Histograms[:0]
+		}
+
 		for i := range vector.Samples {
 			o.pointBuf[0].V = vector.Samples[i]
 			// Call function by separately passing major input and scalars.
@@ -219,6 +243,34 @@ func (o *functionOperator) Next(ctx context.Context) ([]model.StepVector, error)
 	return vectors, nil
 }
 
+// callHistograms evaluates a function which takes native histograms as input.
+// Float samples in the vector are dropped and each histogram is replaced by
+// the float result of the function.
+func (o *functionOperator) callHistograms(vector model.StepVector, scalarPoints []float64) model.StepVector {
+	vector.Samples = vector.Samples[:0]
+	vector.SampleIDs = vector.SampleIDs[:0]
+	for i, h := range vector.Histograms {
+		o.pointBuf[0].H = h
+		result := o.call(FunctionArgs{
+			Labels:       o.series[0],
+			Points:       o.pointBuf,
+			StepTime:     vector.T,
+			ScalarPoints: scalarPoints,
+		})
+		if result.Point == InvalidSample.Point {
+			continue
+		}
+		vector.Samples = append(vector.Samples, result.V)
+		vector.SampleIDs = append(vector.SampleIDs, vector.HistogramIDs[i])
+	}
+	o.pointBuf[0].H = nil
+	if vector.Histograms != nil {
+		vector.HistogramIDs = vector.HistogramIDs[:0]
+		vector.Histograms = vector.Histograms[:0]
+	}
+	return vector
+}
+
 func (o *functionOperator) loadSeries(ctx context.Context) error {
 	var err error
 	o.once.Do(func() {
@@ -0,0 +1,219 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+)
+
+// relabelOperator implements label_replace and label_join. It only rewrites
+// the labels of its input series and passes samples through unchanged.
+type relabelOperator struct {
+	next     model.VectorOperator
+	funcExpr *parser.Call
+	relabel  func(labels.Labels) labels.Labels
+
+	once   sync.Once
+	series []labels.Labels
+
+	// outputIDs maps the ID of each input series to the ID of its relabelled series.
+	// It is only set when several input series have the same labels after relabelling.
+	outputIDs []uint64
+	// seen holds the generation of the step in which each relabelled series last had a sample.
+	seen       []uint64
+	generation uint64
+}
+
+func NewRelabelOperator(next model.VectorOperator, funcExpr *parser.Call) (model.VectorOperator, error) {
+	args := make([]string, len(funcExpr.Args)-1)
+	for i := range args {
+		arg, err := parse.UnwrapString(funcExpr.Args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		args[i] = arg
+	}
+
+	o := &relabelOperator{
+		next:     next,
+		funcExpr: funcExpr,
+	}
+
+	var err error
+	switch funcExpr.Func.Name {
+	case "label_replace":
+		o.relabel, err = newLabelReplace(args[0], args[1], args[2], args[3])
+	case "label_join":
+		o.relabel, err = newLabelJoin(args[0], args[1], args[2:])
+	default:
+		err = errors.Wrapf(parse.ErrNotImplemented, "got %s:", funcExpr.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *relabelOperator) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*relabelOperator] %v(%v)", o.funcExpr.Func.Name, o.funcExpr.Args), []model.VectorOperator{o.next}
+}
+
+func (o *relabelOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *relabelOperator) GetPool() *model.VectorPool {
+	return o.next.GetPool()
+}
+
+func (o *relabelOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := o.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if o.outputIDs == nil {
+		return in, nil
+	}
+
+	// Like in Prometheus, series with the same labels are merged into one series, which
+	// fails if more than one of them has a sample in the same step.
+	for _, vector := range in {
+		o.generation++
+		for i, id := range vector.SampleIDs {
+			if vector.SampleIDs[i], err = o.outputID(id); err != nil {
+				return nil, err
+			}
+		}
+		for i, id := range vector.HistogramIDs {
+			if vector.HistogramIDs[i], err = o.outputID(id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return in, nil
+}
+
+func (o *relabelOperator) outputID(inputID uint64) (uint64, error) {
+	outputID := o.outputIDs[inputID]
+	if o.seen[outputID] == o.generation {
+		return 0, errors.New("vector cannot contain metrics with the same labelset")
+	}
+	o.seen[outputID] = o.generation
+	return outputID, nil
+}
+
+func (o *relabelOperator) loadSeries(ctx context.Context) error {
+	series, err := o.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		hashes    = make(map[uint64]uint64, len(series))
+		outputIDs = make([]uint64, len(series))
+	)
+	o.series = make([]labels.Labels, 0, len(series))
+	for i, s := range series {
+		lbls := o.relabel(s)
+		h := lbls.Hash()
+		outputID, ok := hashes[h]
+		if !ok {
+			outputID = uint64(len(o.series))
+			hashes[h] = outputID
+			o.series = append(o.series, lbls)
+		}
+		outputIDs[i] = outputID
+	}
+	if len(o.series) < len(series) {
+		o.outputIDs = outputIDs
+		o.seen = make([]uint64, len(o.series))
+	}
+	return nil
+}
+
+// newLabelReplace creates a relabel function for label_replace.
+// Copy from https://github.com/prometheus/prometheus/blob/v0.40.1/promql/functions.go#L1040.
+func newLabelReplace(dst, repl, src, regexStr string) (func(labels.Labels) labels.Labels, error) {
+	regex, err := regexp.Compile("^(?:" + regexStr + ")$")
+	if err != nil {
+		return nil, errors.Newf("invalid regular expression in label_replace(): %s", regexStr)
+	}
+	if !prommodel.LabelNameRE.MatchString(dst) {
+		return nil, errors.Newf("invalid destination label name in label_replace(): %s", dst)
+	}
+
+	return func(lbls labels.Labels) labels.Labels {
+		srcVal := lbls.Get(src)
+		indexes := regex.FindStringSubmatchIndex(srcVal)
+		// If there is no match, no replacement should take place.
+		if indexes == nil {
+			return lbls
+		}
+
+		res := regex.ExpandString([]byte{}, repl, srcVal, indexes)
+		lb := labels.NewBuilder(lbls).Del(dst)
+		if len(res) > 0 {
+			lb.Set(dst, string(res))
+		}
+		return lb.Labels(nil)
+	}, nil
+}
+
+// newLabelJoin creates a relabel function for label_join.
+// Copy from https://github.com/prometheus/prometheus/blob/v0.40.1/promql/functions.go#L1103.
+func newLabelJoin(dst, sep string, srcLabels []string) (func(labels.Labels) labels.Labels, error) {
+	for _, src := range srcLabels {
+		if !prommodel.LabelName(src).IsValid() {
+			return nil, errors.Newf("invalid source label name in label_join(): %s", src)
+		}
+	}
+	if !prommodel.LabelName(dst).IsValid() {
+		return nil, errors.Newf("invalid destination label name in label_join(): %s", dst)
+	}
+
+	srcVals := make([]string, len(srcLabels))
+	return func(lbls labels.Labels) labels.Labels {
+		for i, src := range srcLabels {
+			srcVals[i] = lbls.Get(src)
+		}
+
+		lb := labels.NewBuilder(lbls)
+		strval := strings.Join(srcVals, sep)
+		if strval == "" {
+			lb.Del(dst)
+		} else {
+			lb.Set(dst, strval)
+		}
+		return lb.Labels(nil)
+	}, nil
+}
@@ -5,18 +5,40 @@ package model
 
 import (
 	"sync"
+	"unsafe"
+
+	"github.com/prometheus/prometheus/model/histogram"
+
+	"github.com/thanos-community/promql-engine/query"
+)
+
+const (
+	sizeOfStepVector = int(unsafe.Sizeof(StepVector{}))
+	sizeOfFloat64    = int(unsafe.Sizeof(float64(0)))
+	sizeOfUint64     = int(unsafe.Sizeof(uint64(0)))
+	sizeOfPointer    = int(unsafe.Sizeof(uintptr(0)))
 )
 
 type VectorPool struct {
-	vectors sync.Pool
+	vectors    sync.Pool
+	stepsBatch int
 
 	stepSize  int
 	samples   sync.Pool
 	sampleIDs sync.Pool
+
+	histograms   sync.Pool
+	histogramIDs sync.Pool
+
+	memoryTracker *query.MemoryTracker
 }
 
-func NewVectorPool(stepsBatch int) *VectorPool {
-	pool := &VectorPool{}
+// NewVectorPool creates a pool for batches of stepsBatch vectors. Buffers which are
+// taken from the pool are reported to memoryTracker, which can be nil, and are freed
+// once they are put back. Buffers which grew in the meantime report their growth
+// when they are put back, so that it is accounted for in the peak memory of the query.
+func NewVectorPool(stepsBatch int, memoryTracker *query.MemoryTracker) *VectorPool {
+	pool := &VectorPool{stepsBatch: stepsBatch, memoryTracker: memoryTracker}
 	pool.vectors = sync.Pool{
 		New: func() any {
 			sv := make([]StepVector, 0, stepsBatch)
@@ -35,32 +57,99 @@ func NewVectorPool(stepsBatch int) *VectorPool {
 			return &sampleIDs
 		},
 	}
+	pool.histograms = sync.Pool{
+		New: func() any {
+			histograms := make([]*histogram.FloatHistogram, 0, pool.stepSize)
+			return &histograms
+		},
+	}
+	pool.histogramIDs = sync.Pool{
+		New: func() any {
+			histogramIDs := make([]uint64, 0, pool.stepSize)
+			return &histogramIDs
+		},
+	}
 
 	return pool
 }
 
+// GetVectorBatch returns a batch with a capacity of stepsBatch vectors.
 func (p *VectorPool) GetVectorBatch() []StepVector {
-	return *p.vectors.Get().(*[]StepVector)
+	vectors := *p.vectors.Get().(*[]StepVector)
+	p.track(p.stepsBatch * sizeOfStepVector)
+	return vectors
 }
 
 func (p *VectorPool) PutVectors(vector []StepVector) {
+	// Operators which are done return nil batches, which do not come from the pool.
+	if vector == nil {
+		return
+	}
+	// Batches which grew beyond stepsBatch vectors are not reused,
+	// so that batches from the pool always have the tracked capacity.
+	grown := cap(vector) - p.stepsBatch
+	if grown > 0 {
+		p.track(grown * sizeOfStepVector)
+		p.memoryTracker.Free(cap(vector) * sizeOfStepVector)
+		return
+	}
+	p.memoryTracker.Free(p.stepsBatch * sizeOfStepVector)
 	vector = vector[:0]
 	p.vectors.Put(&vector)
 }
 
 func (p *VectorPool) GetStepVector(t int64) StepVector {
-	return StepVector{
+	sv := StepVector{
 		T:         t,
 		SampleIDs: *p.sampleIDs.Get().(*[]uint64),
 		Samples:   *p.samples.Get().(*[]float64),
 	}
+	sv.trackedBytes = sampleBytes(&sv)
+	p.track(sv.trackedBytes)
+	return sv
 }
 
 func (p *VectorPool) PutStepVector(v StepVector) {
+	size := sampleBytes(&v) + histogramBytes(&v)
+	if grown := size - v.trackedBytes; grown > 0 {
+		p.track(grown)
+		v.trackedBytes = size
+	}
+	p.memoryTracker.Free(v.trackedBytes)
+
 	v.SampleIDs = v.SampleIDs[:0]
 	v.Samples = v.Samples[:0]
 	p.sampleIDs.Put(&v.SampleIDs)
 	p.samples.Put(&v.Samples)
+
+	if v.Histograms != nil {
+		v.HistogramIDs = v.HistogramIDs[:0]
+		v.Histograms = v.Histograms[:0]
+		p.histogramIDs.Put(&v.HistogramIDs)
+		p.histograms.Put(&v.Histograms)
+	}
+}
+
+func (p *VectorPool) getHistogramBuffers() ([]uint64, []*histogram.FloatHistogram) {
+	histogramIDs, histograms := *p.histogramIDs.Get().(*[]uint64), *p.histograms.Get().(*[]*histogram.FloatHistogram)
+	p.track(cap(histogramIDs)*sizeOfUint64 + cap(histograms)*sizeOfPointer)
+	return histogramIDs, histograms
+}
+
+// track reports an allocation to the memory tracker. Errors are not returned since
+// the tracker cancels the query once its memory limit is exceeded.
+func (p *VectorPool) track(bytes int) {
+	_ = p.memoryTracker.Alloc(bytes)
+}
+
+// sampleBytes returns the size of the float sample buffers of a vector.
+func sampleBytes(v *StepVector) int {
+	return cap(v.SampleIDs)*sizeOfUint64 + cap(v.Samples)*sizeOfFloat64
+}
+
+// histogramBytes returns the size of the histogram buffers of a vector.
+func histogramBytes(v *StepVector) int {
+	return cap(v.HistogramIDs)*sizeOfUint64 + cap(v.Histograms)*sizeOfPointer
 }
 
 func (p *VectorPool) SetStepSize(n int) {
@@ -3,7 +3,10 @@
 
 package model
 
-import "github.com/prometheus/prometheus/model/labels"
+import (
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+)
 
 type Series struct {
 	// ID is a numerical, zero-based identifier for a series.
@@ -16,4 +19,36 @@ type StepVector struct {
 	T         int64
 	SampleIDs []uint64
 	Samples   []float64
+
+	HistogramIDs []uint64
+	Histograms   []*histogram.FloatHistogram
+
+	// trackedBytes is the size of the buffers of the vector which was reported to the memory tracker.
+	trackedBytes int
+}
+
+// AppendHistogram appends a native histogram sample to the step vector.
+// Histogram buffers are only taken from the pool once the first
+// histogram is appended so that float-only queries do not pay for them.
+func (s *StepVector) AppendHistogram(pool *VectorPool, histogramID uint64, h *histogram.FloatHistogram) {
+	if s.Histograms == nil {
+		s.HistogramIDs, s.Histograms = pool.getHistogramBuffers()
+		s.trackedBytes += histogramBytes(s)
+	}
+	s.HistogramIDs = append(s.HistogramIDs, histogramID)
+	s.Histograms = append(s.Histograms, h)
+}
+
+// NumSamples returns the number of float and histogram samples in the step vector.
+func (s StepVector) NumSamples() int {
+	return len(s.SampleIDs) + len(s.HistogramIDs)
+}
+
+// NumSamples returns the number of float and histogram samples in a batch of step vectors.
+func NumSamples(vectors []StepVector) int {
+	var n int
+	for _, v := range vectors {
+		n += v.NumSamples()
+	}
+	return n
 }
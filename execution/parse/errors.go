@@ -5,6 +5,7 @@ package parse
 
 import (
 	"fmt"
+	"reflect"
 
 	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/promql/parser"
@@ -19,3 +20,53 @@ func UnsupportedOperationErr(op parser.ItemType) error {
 }
 
 var ErrNotImplemented = errors.New("expression not implemented")
+
+// reasonError is an error which is annotated with the reason why an expression is not supported.
+type reasonError struct {
+	error
+	reason string
+}
+
+func (e reasonError) Unwrap() error { return e.error }
+
+// WithReason annotates ErrNotSupportedExpr and ErrNotImplemented errors with the expression
+// which caused them. Only the first annotation is kept, so the innermost expression wins when
+// the error is annotated while it is returned through the plan. Other errors are returned unchanged.
+func WithReason(err error, expr parser.Expr) error {
+	if !errors.Is(err, ErrNotSupportedExpr) && !errors.Is(err, ErrNotImplemented) {
+		return err
+	}
+	var r reasonError
+	if errors.As(err, &r) {
+		return err
+	}
+	return reasonError{error: err, reason: exprReason(expr)}
+}
+
+// Reason returns the reason why an expression is not supported, which is the function name for calls,
+// the operator for aggregations and binary expressions, and the expression type otherwise.
+// The reason is suitable as a metric label since its cardinality is bounded.
+func Reason(err error) string {
+	var r reasonError
+	if errors.As(err, &r) {
+		return r.reason
+	}
+	return errors.Cause(err).Error()
+}
+
+func exprReason(expr parser.Expr) string {
+	switch e := expr.(type) {
+	case *parser.Call:
+		return e.Func.Name
+	case *parser.AggregateExpr:
+		return e.Op.String()
+	case *parser.BinaryExpr:
+		return e.Op.String()
+	default:
+		t := reflect.TypeOf(expr)
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		return t.Name()
+	}
+}
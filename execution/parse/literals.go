@@ -0,0 +1,46 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package parse
+
+import (
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// UnwrapString returns the value of a string literal expression.
+func UnwrapString(expr parser.Expr) (string, error) {
+	switch e := expr.(type) {
+	case *parser.StringLiteral:
+		return e.Val, nil
+	case *parser.ParenExpr:
+		return UnwrapString(e.Expr)
+	case *parser.StepInvariantExpr:
+		return UnwrapString(e.Expr)
+	default:
+		return "", errors.Wrapf(ErrNotImplemented, "got non-literal string parameter: %s", expr)
+	}
+}
+
+// UnwrapFloat returns the value of a number literal expression.
+func UnwrapFloat(expr parser.Expr) (float64, error) {
+	switch e := expr.(type) {
+	case *parser.NumberLiteral:
+		return e.Val, nil
+	case *parser.ParenExpr:
+		return UnwrapFloat(e.Expr)
+	case *parser.StepInvariantExpr:
+		return UnwrapFloat(e.Expr)
+	case *parser.UnaryExpr:
+		v, err := UnwrapFloat(e.Expr)
+		if err != nil {
+			return 0, err
+		}
+		if e.Op == parser.SUB {
+			return -v, nil
+		}
+		return v, nil
+	default:
+		return 0, errors.Wrapf(ErrNotImplemented, "got non-literal number parameter: %s", expr)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 
@@ -23,9 +24,13 @@ type Execution struct {
 }
 
 func NewExecution(query promql.Query, pool *model.VectorPool, opts *query.Options) *Execution {
+	// Remote engines return samples at the timestamps of the query steps, so a step
+	// without a remote sample must not be filled with the sample of a previous step.
+	selectorOpts := *opts
+	selectorOpts.LookbackDelta = 0
 	return &Execution{
 		query:          query,
-		vectorSelector: scan.NewVectorSelector(pool, newStorageFromQuery(query), opts, 0, 0, 1),
+		vectorSelector: scan.NewVectorSelector(pool, newStorageFromQuery(query, opts), &selectorOpts, 0, 0, 1, false),
 	}
 }
 
@@ -47,15 +52,17 @@ func (e *Execution) Explain() (me string, next []model.VectorOperator) {
 
 type storageAdapter struct {
 	query promql.Query
+	opts  *query.Options
 
 	once   sync.Once
 	err    error
 	series []engstore.SignedSeries
 }
 
-func newStorageFromQuery(query promql.Query) *storageAdapter {
+func newStorageFromQuery(query promql.Query, opts *query.Options) *storageAdapter {
 	return &storageAdapter{
 		query: query,
+		opts:  opts,
 	}
 }
 
@@ -73,7 +80,18 @@ func (s *storageAdapter) GetSeries(ctx context.Context, _, _ int) ([]engstore.Si
 func (s *storageAdapter) executeQuery(ctx context.Context) {
 	defer s.query.Close()
 	result := s.query.Exec(ctx)
+	// Warnings of remote engines can signal that their data is incomplete,
+	// so they are returned with the result of the query.
+	for _, w := range result.Warnings {
+		s.opts.Warnings.Add(w)
+	}
 	if result.Err != nil {
+		// With partial responses, a failed remote engine does not contribute any series
+		// to the result. Errors caused by the cancellation of the query still fail it.
+		if s.opts.EnablePartialResponse && ctx.Err() == nil {
+			s.opts.Warnings.Add(errors.Wrapf(result.Err, "remote execution of %s", s.query))
+			return
+		}
 		s.err = result.Err
 		return
 	}
@@ -94,9 +112,16 @@ func (s *storageAdapter) executeQuery(ctx context.Context) {
 				Signature: uint64(i),
 				Series: promql.NewStorageSeries(promql.Series{
 					Metric: point.Metric,
-					Points: []promql.Point{{T: point.T, V: point.V}},
+					Points: []promql.Point{{T: point.T, V: point.V, H: point.H}},
 				}),
 			}
 		}
+	case promql.Scalar:
+		s.series = []engstore.SignedSeries{{
+			Series: promql.NewStorageSeries(promql.Series{
+				Metric: labels.Labels{},
+				Points: []promql.Point{{T: val.T, V: val.V}},
+			}),
+		}}
 	}
 }
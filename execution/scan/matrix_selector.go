@@ -6,9 +6,11 @@ package scan
 import (
 	"context"
 	"fmt"
+	"math"
 	"sort"
 	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/value"
@@ -23,6 +25,8 @@ import (
 	"github.com/thanos-community/promql-engine/query"
 )
 
+const sizeOfPoint = int(unsafe.Sizeof(promql.Point{}))
+
 type matrixScanner struct {
 	labels         labels.Labels
 	signature      uint64
@@ -38,6 +42,11 @@ type matrixSelector struct {
 	series   []labels.Labels
 	once     sync.Once
 
+	// scalarArgs are the operators for the scalar arguments of the function,
+	// and scalarPoints holds their values for each step of the current batch.
+	scalarArgs   []model.VectorOperator
+	scalarPoints [][]float64
+
 	vectorPool *model.VectorPool
 
 	numSteps    int
@@ -50,24 +59,37 @@ type matrixSelector struct {
 
 	shard     int
 	numShards int
+
+	sampleTracker *query.SampleTracker
+	sampleLimiter *query.SampleLimiter
+	memoryTracker *query.MemoryTracker
+	// samplesPerStep is a reusable buffer for the number of samples selected in each step of a batch.
+	samplesPerStep []int
+	// valuesBuffer is a reusable buffer for functions which need the values of a range.
+	valuesBuffer []float64
 }
 
 // NewMatrixSelector creates operator which selects vector of series over time.
+// The values of scalarArgs, which are the remaining arguments of the function
+// in the order in which they appear, are passed to the function for each step.
 func NewMatrixSelector(
 	pool *model.VectorPool,
 	selector engstore.SeriesSelector,
 	call function.FunctionCall,
 	funcExpr *parser.Call,
+	scalarArgs []model.VectorOperator,
 	opts *query.Options,
 	selectRange, offset time.Duration,
 	shard, numShard int,
 ) model.VectorOperator {
 	// TODO(fpetkovski): Add offset parameter.
 	return &matrixSelector{
-		storage:    selector,
-		call:       call,
-		funcExpr:   funcExpr,
-		vectorPool: pool,
+		storage:      selector,
+		call:         call,
+		funcExpr:     funcExpr,
+		scalarArgs:   scalarArgs,
+		scalarPoints: newScalarPoints(int(opts.StepsBatch), len(scalarArgs)),
+		vectorPool:   pool,
 
 		numSteps: opts.NumSteps(),
 		mint:     opts.Start.UnixMilli(),
@@ -80,13 +102,18 @@ func NewMatrixSelector(
 
 		shard:     shard,
 		numShards: numShard,
+
+		sampleTracker:  opts.SampleTracker,
+		sampleLimiter:  opts.SampleLimiter,
+		memoryTracker:  opts.MemoryTracker,
+		samplesPerStep: make([]int, opts.NumSteps()),
 	}
 }
 
 func (o *matrixSelector) Explain() (me string, next []model.VectorOperator) {
 	r := time.Duration(o.selectRange) * time.Millisecond
 	if o.call != nil {
-		return fmt.Sprintf("[*matrixSelector] %v({%v}[%s] %v mod %v)", o.funcExpr.Func.Name, o.storage.Matchers(), r, o.shard, o.numShards), nil
+		return fmt.Sprintf("[*matrixSelector] %v({%v}[%s] %v mod %v)", o.funcExpr.Func.Name, o.storage.Matchers(), r, o.shard, o.numShards), o.scalarArgs
 	}
 	return fmt.Sprintf("[*matrixSelector] {%v}[%s] %v mod %v", o.storage.Matchers(), r, o.shard, o.numShards), nil
 }
@@ -110,19 +137,29 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 	}
 
 	if o.currentStep > o.maxt {
+		for i := range o.scanners {
+			o.releasePoints(i)
+		}
 		return nil, nil
 	}
 
 	if err := o.loadSeries(ctx); err != nil {
 		return nil, err
 	}
+	if err := loadScalarPoints(ctx, o.scalarArgs, o.scalarPoints); err != nil {
+		return nil, err
+	}
 
 	vectors := o.vectorPool.GetVectorBatch()
 	ts := o.currentStep
+	for i := range o.samplesPerStep {
+		o.samplesPerStep[i] = 0
+	}
 	for i := 0; i < len(o.scanners); i++ {
 		var (
-			series   = o.scanners[i]
-			seriesTs = ts
+			series     = o.scanners[i]
+			seriesTs   = ts
+			numOutputs int
 		)
 
 		for currStep := 0; currStep < o.numSteps && seriesTs <= o.maxt; currStep++ {
@@ -135,26 +172,54 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 			if err != nil {
 				return nil, err
 			}
+			if grown := cap(rangePoints) - cap(o.scanners[i].previousPoints); grown > 0 {
+				if err := o.memoryTracker.Alloc(grown * sizeOfPoint); err != nil {
+					return nil, err
+				}
+			}
+			if o.call != nil && len(rangePoints) > 0 {
+				if err := function.CheckScalarArgs(o.funcExpr, o.scalarPoints[currStep]); err != nil {
+					return nil, err
+				}
+			}
+			o.samplesPerStep[currStep] += len(rangePoints)
+			// Points of the range are held until they fall out of the range of a later step.
+			if held := len(rangePoints) - len(o.scanners[i].previousPoints); held > 0 {
+				if err := o.sampleLimiter.Add(held); err != nil {
+					return nil, err
+				}
+			} else {
+				o.sampleLimiter.Remove(-held)
+			}
 
-			// TODO(saswatamcode): Handle multi-arg functions for matrixSelectors.
-			// Also, allow operator to exist independently without being nested
+			// TODO(saswatamcode): Allow operator to exist independently without being nested
 			// under parser.Call by implementing new data model.
 			// https://github.com/thanos-community/promql-engine/issues/39
 			result := o.call(function.FunctionArgs{
-				Labels:      series.labels,
-				Points:      rangePoints,
-				StepTime:    seriesTs,
-				SelectRange: o.selectRange,
-				Offset:      o.offset,
+				Labels:       series.labels,
+				Points:       rangePoints,
+				StepTime:     seriesTs,
+				SelectRange:  o.selectRange,
+				ScalarPoints: o.scalarPoints[currStep],
+				Offset:       o.offset,
+				ValuesBuffer: &o.valuesBuffer,
 			})
 
 			if result.Point != function.InvalidSample.Point {
+				numOutputs++
 				vectors[currStep].T = result.T
-				vectors[currStep].Samples = append(vectors[currStep].Samples, result.V)
-				vectors[currStep].SampleIDs = append(vectors[currStep].SampleIDs, series.signature)
+				if result.H != nil {
+					vectors[currStep].AppendHistogram(o.vectorPool, series.signature, result.H)
+				} else {
+					vectors[currStep].Samples = append(vectors[currStep].Samples, result.V)
+					vectors[currStep].SampleIDs = append(vectors[currStep].SampleIDs, series.signature)
+				}
 			}
 
 			o.scanners[i].previousPoints = rangePoints
+			if len(rangePoints) == 0 {
+				o.releasePoints(i)
+			}
 
 			// Only buffer stepRange milliseconds from the second step on.
 			stepRange := o.selectRange
@@ -165,6 +230,17 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 
 			seriesTs += o.step
 		}
+		// Like in Prometheus, the output samples of a series are accounted for once all its
+		// steps are evaluated, and the points of a series are dropped after its last step.
+		if err := o.sampleLimiter.Add(numOutputs); err != nil {
+			return nil, err
+		}
+		if o.step == 0 || seriesTs > o.maxt {
+			o.releasePoints(i)
+		}
+	}
+	for i := range vectors {
+		o.sampleTracker.AddSamplesAtTimestamp(vectors[i].T, o.samplesPerStep[i])
 	}
 	// For instant queries, set the step to a positive value
 	// so that the operator can terminate.
@@ -176,6 +252,13 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 	return vectors, nil
 }
 
+// releasePoints drops the points which are buffered for a series and frees their memory.
+func (o *matrixSelector) releasePoints(i int) {
+	o.sampleLimiter.Remove(len(o.scanners[i].previousPoints))
+	o.memoryTracker.Free(cap(o.scanners[i].previousPoints) * sizeOfPoint)
+	o.scanners[i].previousPoints = nil
+}
+
 func (o *matrixSelector) loadSeries(ctx context.Context) error {
 	var err error
 	o.once.Do(func() {
@@ -184,6 +267,7 @@ func (o *matrixSelector) loadSeries(ctx context.Context) error {
 			err = loadErr
 			return
 		}
+		o.sampleTracker.AddSeries(len(series))
 
 		o.scanners = make([]matrixScanner, len(series))
 		o.series = make([]labels.Labels, len(series))
@@ -212,6 +296,41 @@ func (o *matrixSelector) loadSeries(ctx context.Context) error {
 	return err
 }
 
+// newScalarPoints creates a buffer for the values of numArgs scalar arguments
+// for each step in a batch.
+func newScalarPoints(stepsBatch, numArgs int) [][]float64 {
+	scalarPoints := make([][]float64, stepsBatch)
+	for i := range scalarPoints {
+		scalarPoints[i] = make([]float64, numArgs)
+	}
+	return scalarPoints
+}
+
+// loadScalarPoints reads the next batch of each scalar argument into scalarPoints.
+// Steps for which an argument has no value are set to NaN.
+func loadScalarPoints(ctx context.Context, args []model.VectorOperator, scalarPoints [][]float64) error {
+	for i, arg := range args {
+		vectors, err := arg.Next(ctx)
+		if err != nil {
+			return err
+		}
+		for step := range scalarPoints {
+			val := math.NaN()
+			if step < len(vectors) && len(vectors[step].Samples) > 0 {
+				val = vectors[step].Samples[0]
+			}
+			scalarPoints[step][i] = val
+		}
+		for _, vector := range vectors {
+			arg.GetPool().PutStepVector(vector)
+		}
+		if vectors != nil {
+			arg.GetPool().PutVectors(vectors)
+		}
+	}
+	return nil
+}
+
 // matrixIterSlice populates a matrix vector covering the requested range for a
 // single time series, with points retrieved from an iterator.
 //
@@ -220,7 +339,6 @@ func (o *matrixSelector) loadSeries(ctx context.Context) error {
 // values). Any such points falling before mint are discarded; points that fall
 // into the [mint, maxt] range are retained; only points with later timestamps
 // are populated from the iterator.
-// TODO(fpetkovski): Add max samples limit.
 func selectPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out []promql.Point) ([]promql.Point, error) {
 	if len(out) > 0 && out[len(out)-1].T >= mint {
 		// There is an overlap between previous and current ranges, retain common
@@ -253,7 +371,14 @@ loop:
 		case chunkenc.ValNone:
 			break loop
 		case chunkenc.ValFloatHistogram, chunkenc.ValHistogram:
-			return nil, ErrNativeHistogramsUnsupported
+			t, h := buf.AtFloatHistogram()
+			if value.IsStaleNaN(h.Sum) {
+				continue loop
+			}
+			// Values in the buffer are guaranteed to be smaller than maxt.
+			if t >= mint {
+				out = append(out, promql.Point{T: t, H: h})
+			}
 		case chunkenc.ValFloat:
 			t, v := buf.At()
 			if value.IsStaleNaN(v) {
@@ -269,7 +394,10 @@ loop:
 	// The sought sample might also be in the range.
 	switch soughtValueType {
 	case chunkenc.ValFloatHistogram, chunkenc.ValHistogram:
-		return nil, ErrNativeHistogramsUnsupported
+		t, h := it.AtFloatHistogram()
+		if t == maxt && !value.IsStaleNaN(h.Sum) {
+			out = append(out, promql.Point{T: t, H: h})
+		}
 	case chunkenc.ValFloat:
 		t, v := it.At()
 		if t == maxt && !value.IsStaleNaN(v) {
@@ -0,0 +1,278 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package scan
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/function"
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+type subqueryOperator struct {
+	next     model.VectorOperator
+	pool     *model.VectorPool
+	call     function.FunctionCall
+	funcExpr *parser.Call
+	subQuery *parser.SubqueryExpr
+
+	// scalarArgs are the operators for the scalar arguments of the function,
+	// and scalarPoints holds their values for each step of the current batch.
+	scalarArgs   []model.VectorOperator
+	scalarPoints [][]float64
+
+	once   sync.Once
+	series []labels.Labels
+
+	mint        int64
+	maxt        int64
+	currentStep int64
+	step        int64
+	stepsBatch  int
+
+	// lastVectors holds the batch of inner vectors which was only partially
+	// consumed by the previous step, starting at lastCollected.
+	lastVectors   []model.StepVector
+	lastCollected int
+	buffers       [][]promql.Point
+	// valuesBuffer is a reusable buffer for functions which need the values of a range.
+	valuesBuffer []float64
+
+	selectRange int64
+	offset      int64
+
+	sampleTracker *query.SampleTracker
+	sampleLimiter *query.SampleLimiter
+	memoryTracker *query.MemoryTracker
+}
+
+// NewSubqueryOperator creates an operator which evaluates a range function
+// over the result of a subquery. The inner operator is expected to be evaluated
+// at the resolution and time range of the subquery, while scalarArgs are evaluated
+// at the resolution of the outer query.
+func NewSubqueryOperator(
+	pool *model.VectorPool,
+	next model.VectorOperator,
+	call function.FunctionCall,
+	funcExpr *parser.Call,
+	subQuery *parser.SubqueryExpr,
+	scalarArgs []model.VectorOperator,
+	opts *query.Options,
+) model.VectorOperator {
+	step := opts.Step.Milliseconds()
+	if step == 0 {
+		step = 1
+	}
+	return &subqueryOperator{
+		next:     next,
+		call:     call,
+		pool:     pool,
+		funcExpr: funcExpr,
+		subQuery: subQuery,
+
+		scalarArgs:   scalarArgs,
+		scalarPoints: newScalarPoints(int(opts.StepsBatch), len(scalarArgs)),
+
+		mint:        opts.Start.UnixMilli(),
+		maxt:        opts.End.UnixMilli(),
+		currentStep: opts.Start.UnixMilli(),
+		step:        step,
+		stepsBatch:  int(opts.StepsBatch),
+
+		selectRange: subQuery.Range.Milliseconds(),
+		offset:      subQuery.Offset.Milliseconds(),
+
+		sampleTracker: opts.SampleTracker,
+		sampleLimiter: opts.SampleLimiter,
+		memoryTracker: opts.MemoryTracker,
+	}
+}
+
+func (o *subqueryOperator) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*subqueryOperator] %v()", o.funcExpr.Func.Name), append([]model.VectorOperator{o.next}, o.scalarArgs...)
+}
+
+func (o *subqueryOperator) GetPool() *model.VectorPool { return o.pool }
+
+func (o *subqueryOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if o.currentStep > o.maxt {
+		for sid := range o.buffers {
+			o.releaseBuffer(sid)
+		}
+		return nil, nil
+	}
+
+	var err error
+	o.once.Do(func() { err = o.initSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	if err := loadScalarPoints(ctx, o.scalarArgs, o.scalarPoints); err != nil {
+		return nil, err
+	}
+
+	res := o.pool.GetVectorBatch()
+	for i := 0; i < o.stepsBatch && o.currentStep <= o.maxt; i++ {
+		maxt := o.currentStep - o.offset
+		mint := maxt - o.selectRange
+
+		// Buffered points keep the samples reserved by the inner operator
+		// until they fall out of the range.
+		for sid := range o.buffers {
+			numPoints := len(o.buffers[sid])
+			o.buffers[sid] = dropBefore(o.buffers[sid], mint)
+			o.sampleLimiter.Remove(numPoints - len(o.buffers[sid]))
+			if len(o.buffers[sid]) == 0 {
+				o.releaseBuffer(sid)
+			}
+		}
+		if err := o.collect(ctx, maxt); err != nil {
+			return nil, err
+		}
+
+		sv := o.pool.GetStepVector(o.currentStep)
+		var numSamples int
+		for sid, points := range o.buffers {
+			if len(points) == 0 {
+				continue
+			}
+			if err := function.CheckScalarArgs(o.funcExpr, o.scalarPoints[i]); err != nil {
+				return nil, err
+			}
+			numSamples += len(points)
+			result := o.call(function.FunctionArgs{
+				Labels:       o.series[sid],
+				Points:       points,
+				StepTime:     o.currentStep,
+				SelectRange:  o.selectRange,
+				ScalarPoints: o.scalarPoints[i],
+				Offset:       o.offset,
+				ValuesBuffer: &o.valuesBuffer,
+			})
+			if result.Point != function.InvalidSample.Point {
+				if result.H != nil {
+					sv.AppendHistogram(o.pool, uint64(sid), result.H)
+				} else {
+					sv.Samples = append(sv.Samples, result.V)
+					sv.SampleIDs = append(sv.SampleIDs, uint64(sid))
+				}
+			}
+		}
+		res = append(res, sv)
+		o.sampleTracker.AddSamplesAtTimestamp(o.currentStep, numSamples)
+		if err := o.sampleLimiter.Add(sv.NumSamples()); err != nil {
+			return nil, err
+		}
+
+		o.currentStep += o.step
+	}
+	return res, nil
+}
+
+// collect buffers all inner samples with a timestamp up to and including maxt.
+func (o *subqueryOperator) collect(ctx context.Context, maxt int64) error {
+	for {
+		if o.lastVectors == nil {
+			vectors, err := o.next.Next(ctx)
+			if err != nil {
+				return err
+			}
+			if vectors == nil {
+				return nil
+			}
+			o.lastVectors = vectors
+			o.lastCollected = 0
+		}
+
+		for ; o.lastCollected < len(o.lastVectors); o.lastCollected++ {
+			vector := o.lastVectors[o.lastCollected]
+			if vector.T > maxt {
+				return nil
+			}
+			for j, sid := range vector.SampleIDs {
+				if err := o.bufferPoint(sid, promql.Point{T: vector.T, V: vector.Samples[j]}); err != nil {
+					return err
+				}
+			}
+			for j, sid := range vector.HistogramIDs {
+				if err := o.bufferPoint(sid, promql.Point{T: vector.T, H: vector.Histograms[j]}); err != nil {
+					return err
+				}
+			}
+			o.next.GetPool().PutStepVector(vector)
+		}
+		o.next.GetPool().PutVectors(o.lastVectors)
+		o.lastVectors = nil
+	}
+}
+
+// bufferPoint appends a point to the buffer of a series and reports the memory
+// of the buffer if it had to grow.
+func (o *subqueryOperator) bufferPoint(sid uint64, p promql.Point) error {
+	oldCap := cap(o.buffers[sid])
+	o.buffers[sid] = append(o.buffers[sid], p)
+	if grown := cap(o.buffers[sid]) - oldCap; grown > 0 {
+		return o.memoryTracker.Alloc(grown * sizeOfPoint)
+	}
+	return nil
+}
+
+// releaseBuffer drops the buffer of a series, which is allocated again once
+// the series has new points, and frees its memory.
+func (o *subqueryOperator) releaseBuffer(sid int) {
+	o.memoryTracker.Free(cap(o.buffers[sid]) * sizeOfPoint)
+	o.buffers[sid] = nil
+}
+
+func (o *subqueryOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.initSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *subqueryOperator) initSeries(ctx context.Context) error {
+	series, err := o.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	o.series = make([]labels.Labels, len(series))
+	o.buffers = make([][]promql.Point, len(series))
+	for i, s := range series {
+		lbls := s
+		if o.funcExpr.Func.Name != "last_over_time" {
+			lbls, _ = function.DropMetricName(s.Copy())
+		}
+		o.series[i] = lbls
+	}
+	o.pool.SetStepSize(len(series))
+	return nil
+}
+
+// dropBefore removes all points with a timestamp before mint.
+func dropBefore(points []promql.Point, mint int64) []promql.Point {
+	var drop int
+	for drop = 0; drop < len(points) && points[drop].T < mint; drop++ {
+	}
+	if drop == 0 {
+		return points
+	}
+	copy(points, points[drop:])
+	return points[:len(points)-drop]
+}
@@ -12,18 +12,18 @@ import (
 	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 
+	"github.com/thanos-community/promql-engine/execution/function"
 	"github.com/thanos-community/promql-engine/execution/model"
 	engstore "github.com/thanos-community/promql-engine/execution/storage"
 	"github.com/thanos-community/promql-engine/query"
 
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/value"
 
 	"github.com/prometheus/prometheus/storage"
 )
 
-var ErrNativeHistogramsUnsupported = errors.Newf("querying native histograms is not supported")
-
 type vectorScanner struct {
 	labels    labels.Labels
 	signature uint64
@@ -48,6 +48,15 @@ type vectorSelector struct {
 
 	shard     int
 	numShards int
+
+	sampleTracker *query.SampleTracker
+	sampleLimiter *query.SampleLimiter
+	// samplesPerStep is a reusable buffer for the number of samples selected in each step of a batch.
+	samplesPerStep []int
+
+	// selectTimestamp is set for the argument of the timestamp function, in which
+	// case the operator returns the timestamps of samples instead of their values.
+	selectTimestamp bool
 }
 
 // NewVectorSelector creates operator which selects vector of series.
@@ -57,6 +66,7 @@ func NewVectorSelector(
 	queryOpts *query.Options,
 	offset time.Duration,
 	shard, numShards int,
+	selectTimestamp bool,
 ) model.VectorOperator {
 	return &vectorSelector{
 		storage:    selector,
@@ -72,10 +82,19 @@ func NewVectorSelector(
 
 		shard:     shard,
 		numShards: numShards,
+
+		sampleTracker:  queryOpts.SampleTracker,
+		sampleLimiter:  queryOpts.SampleLimiter,
+		samplesPerStep: make([]int, queryOpts.NumSteps()),
+
+		selectTimestamp: selectTimestamp,
 	}
 }
 
 func (o *vectorSelector) Explain() (me string, next []model.VectorOperator) {
+	if o.selectTimestamp {
+		return fmt.Sprintf("[*vectorSelector] timestamp({%v}) %v mod %v", o.storage.Matchers(), o.shard, o.numShards), nil
+	}
 	return fmt.Sprintf("[*vectorSelector] {%v} %v mod %v", o.storage.Matchers(), o.shard, o.numShards), nil
 }
 
@@ -107,6 +126,9 @@ func (o *vectorSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 
 	vectors := o.vectorPool.GetVectorBatch()
 	ts := o.currentStep
+	for i := range o.samplesPerStep {
+		o.samplesPerStep[i] = 0
+	}
 	for i := 0; i < len(o.scanners); i++ {
 		var (
 			series   = o.scanners[i]
@@ -117,17 +139,33 @@ func (o *vectorSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 			if len(vectors) <= currStep {
 				vectors = append(vectors, o.vectorPool.GetStepVector(seriesTs))
 			}
-			_, v, ok, err := selectPoint(series.samples, seriesTs, o.lookbackDelta, o.offset)
+			t, v, h, ok, err := selectPoint(series.samples, seriesTs, o.lookbackDelta, o.offset)
 			if err != nil {
 				return nil, err
 			}
 			if ok {
-				vectors[currStep].SampleIDs = append(vectors[currStep].SampleIDs, series.signature)
-				vectors[currStep].Samples = append(vectors[currStep].Samples, v)
+				o.samplesPerStep[currStep]++
+				if o.selectTimestamp {
+					v, h = float64(t)/1000, nil
+				}
+				if h != nil {
+					vectors[currStep].AppendHistogram(o.vectorPool, series.signature, h)
+				} else {
+					vectors[currStep].SampleIDs = append(vectors[currStep].SampleIDs, series.signature)
+					vectors[currStep].Samples = append(vectors[currStep].Samples, v)
+				}
 			}
 			seriesTs += o.step
 		}
 	}
+	var numSamples int
+	for i := range vectors {
+		o.sampleTracker.AddSamplesAtTimestamp(vectors[i].T, o.samplesPerStep[i])
+		numSamples += o.samplesPerStep[i]
+	}
+	if err := o.sampleLimiter.Add(numSamples); err != nil {
+		return nil, err
+	}
 	// For instant queries, set the step to a positive value
 	// so that the operator can terminate.
 	if o.step == 0 {
@@ -146,50 +184,56 @@ func (o *vectorSelector) loadSeries(ctx context.Context) error {
 			err = loadErr
 			return
 		}
+		o.sampleTracker.AddSeries(len(series))
 
 		o.scanners = make([]vectorScanner, len(series))
 		o.series = make([]labels.Labels, len(series))
 		for i, s := range series {
+			lbls := s.Labels()
+			if o.selectTimestamp {
+				// Labels can be shared between Select() calls, so they are copied before being modified.
+				lbls, _ = function.DropMetricName(lbls.Copy())
+			}
 			o.scanners[i] = vectorScanner{
-				labels:    s.Labels(),
+				labels:    lbls,
 				signature: s.Signature,
 				samples:   storage.NewMemoizedIterator(s.Iterator(), o.lookbackDelta),
 			}
-			o.series[i] = s.Labels()
+			o.series[i] = lbls
 		}
 		o.vectorPool.SetStepSize(len(series))
 	})
 	return err
 }
 
-// TODO(fpetkovski): Add max samples limit.
-func selectPoint(it *storage.MemoizedSeriesIterator, ts, lookbackDelta, offset int64) (int64, float64, bool, error) {
+func selectPoint(it *storage.MemoizedSeriesIterator, ts, lookbackDelta, offset int64) (int64, float64, *histogram.FloatHistogram, bool, error) {
 	refTime := ts - offset
 	var t int64
 	var v float64
+	var h *histogram.FloatHistogram
 
 	valueType := it.Seek(refTime)
 	switch valueType {
 	case chunkenc.ValNone:
 		if it.Err() != nil {
-			return 0, 0, false, it.Err()
+			return 0, 0, nil, false, it.Err()
 		}
-	case chunkenc.ValHistogram, chunkenc.ValFloatHistogram:
-		return 0, 0, false, ErrNativeHistogramsUnsupported
 	case chunkenc.ValFloat:
 		t, v = it.At()
+	case chunkenc.ValHistogram, chunkenc.ValFloatHistogram:
+		t, h = it.AtFloatHistogram()
 	default:
 		panic(errors.Newf("unknown value type %v", valueType))
 	}
 	if valueType == chunkenc.ValNone || t > refTime {
 		var ok bool
-		t, v, _, _, ok = it.PeekPrev()
+		t, v, _, h, ok = it.PeekPrev()
 		if !ok || t < refTime-lookbackDelta {
-			return 0, 0, false, nil
+			return 0, 0, nil, false, nil
 		}
 	}
-	if value.IsStaleNaN(v) {
-		return 0, 0, false, nil
+	if value.IsStaleNaN(v) || (h != nil && value.IsStaleNaN(h.Sum)) {
+		return 0, 0, nil, false, nil
 	}
-	return t, v, true, nil
+	return t, v, h, true, nil
 }
@@ -102,7 +102,7 @@ func (u *stepInvariantOperator) Next(ctx context.Context) ([]model.StepVector, e
 		return nil, err
 	}
 
-	if len(u.cachedVector.Samples) == 0 {
+	if len(u.cachedVector.Samples) == 0 && len(u.cachedVector.Histograms) == 0 {
 		return nil, nil
 	}
 
@@ -111,6 +111,9 @@ func (u *stepInvariantOperator) Next(ctx context.Context) ([]model.StepVector, e
 		outVector := u.vectorPool.GetStepVector(u.currentStep)
 		outVector.Samples = append(outVector.Samples, u.cachedVector.Samples...)
 		outVector.SampleIDs = append(outVector.SampleIDs, u.cachedVector.SampleIDs...)
+		for j := range u.cachedVector.Histograms {
+			outVector.AppendHistogram(u.vectorPool, u.cachedVector.HistogramIDs[j], u.cachedVector.Histograms[j])
+		}
 		result = append(result, outVector)
 		u.currentStep += u.step
 	}
@@ -128,7 +131,7 @@ func (u *stepInvariantOperator) cacheInputVector(ctx context.Context) error {
 		}
 		defer u.next.GetPool().PutVectors(in)
 
-		if len(in) == 0 || len(in[0].Samples) == 0 {
+		if len(in) == 0 || (len(in[0].Samples) == 0 && len(in[0].Histograms) == 0) {
 			return
 		}
 
@@ -144,6 +147,9 @@ func (u *stepInvariantOperator) cacheInputVector(ctx context.Context) error {
 		u.cachedVector = u.vectorPool.GetStepVector(0)
 		u.cachedVector.Samples = append(u.cachedVector.Samples, in[0].Samples...)
 		u.cachedVector.SampleIDs = append(u.cachedVector.SampleIDs, in[0].SampleIDs...)
+		for j := range in[0].Histograms {
+			u.cachedVector.AppendHistogram(u.vectorPool, in[0].HistogramIDs[j], in[0].Histograms[j])
+		}
 		u.next.GetPool().PutStepVector(in[0])
 	})
 	return err
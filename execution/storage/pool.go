@@ -11,6 +11,8 @@ import (
 	"github.com/cespare/xxhash/v2"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/query"
 )
 
 var sep = []byte{'\xff'}
@@ -18,20 +20,24 @@ var sep = []byte{'\xff'}
 type SelectorPool struct {
 	selectors map[uint64]*seriesSelector
 
-	queryable storage.Queryable
+	queryable     storage.Queryable
+	memoryTracker *query.MemoryTracker
 }
 
-func NewSelectorPool(queryable storage.Queryable) *SelectorPool {
+// NewSelectorPool creates a pool of selectors which report the memory used
+// for loaded series to memoryTracker, which can be nil.
+func NewSelectorPool(queryable storage.Queryable, memoryTracker *query.MemoryTracker) *SelectorPool {
 	return &SelectorPool{
-		selectors: make(map[uint64]*seriesSelector),
-		queryable: queryable,
+		selectors:     make(map[uint64]*seriesSelector),
+		queryable:     queryable,
+		memoryTracker: memoryTracker,
 	}
 }
 
 func (p *SelectorPool) GetSelector(mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints) SeriesSelector {
 	key := hashMatchers(matchers, mint, maxt, hints)
 	if _, ok := p.selectors[key]; !ok {
-		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints)
+		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints, p.memoryTracker)
 	}
 	return p.selectors[key]
 }
@@ -39,7 +45,7 @@ func (p *SelectorPool) GetSelector(mint, maxt, step int64, matchers []*labels.Ma
 func (p *SelectorPool) GetFilteredSelector(mint, maxt, step int64, matchers, filters []*labels.Matcher, hints storage.SelectHints) SeriesSelector {
 	key := hashMatchers(matchers, mint, maxt, hints)
 	if _, ok := p.selectors[key]; !ok {
-		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints)
+		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints, p.memoryTracker)
 	}
 
 	return NewFilteredSelector(p.selectors[key], NewFilter(filters))
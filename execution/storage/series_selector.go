@@ -6,9 +6,17 @@ package storage
 import (
 	"context"
 	"sync"
+	"unsafe"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/query"
+)
+
+const (
+	sizeOfSignedSeries = int(unsafe.Sizeof(SignedSeries{}))
+	sizeOfLabel        = int(unsafe.Sizeof(labels.Label{}))
 )
 
 type SeriesSelector interface {
@@ -31,9 +39,11 @@ type seriesSelector struct {
 
 	once   sync.Once
 	series []SignedSeries
+
+	memoryTracker *query.MemoryTracker
 }
 
-func newSeriesSelector(storage storage.Queryable, mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints) *seriesSelector {
+func newSeriesSelector(storage storage.Queryable, mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints, memoryTracker *query.MemoryTracker) *seriesSelector {
 	return &seriesSelector{
 		storage:  storage,
 		maxt:     maxt,
@@ -41,6 +51,8 @@ func newSeriesSelector(storage storage.Queryable, mint, maxt, step int64, matche
 		step:     step,
 		matchers: matchers,
 		hints:    hints,
+
+		memoryTracker: memoryTracker,
 	}
 }
 
@@ -69,6 +81,9 @@ func (o *seriesSelector) loadSeries(ctx context.Context) error {
 	i := 0
 	for seriesSet.Next() {
 		s := seriesSet.At()
+		if err := o.memoryTracker.Alloc(seriesSize(s.Labels())); err != nil {
+			return err
+		}
 		o.series = append(o.series, SignedSeries{
 			Series:    s,
 			Signature: uint64(i),
@@ -79,6 +94,15 @@ func (o *seriesSelector) loadSeries(ctx context.Context) error {
 	return seriesSet.Err()
 }
 
+// seriesSize estimates the memory used by a loaded series with the given labels.
+func seriesSize(lbls labels.Labels) int {
+	size := sizeOfSignedSeries + len(lbls)*sizeOfLabel
+	for _, l := range lbls {
+		size += len(l.Name) + len(l.Value)
+	}
+	return size
+}
+
 func seriesShard(series []SignedSeries, index int, numShards int) []SignedSeries {
 	start := index * len(series) / numShards
 	end := (index + 1) * len(series) / numShards
@@ -0,0 +1,13 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+//go:build !linux
+
+package telemetry
+
+import "time"
+
+// threadCPUTime returns false, since the CPU time of threads is only measured on Linux.
+func threadCPUTime() (time.Duration, bool) {
+	return 0, false
+}
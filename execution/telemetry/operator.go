@@ -0,0 +1,212 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+const tracerName = "github.com/thanos-community/promql-engine"
+
+// Stats are the execution statistics of a single operator.
+type Stats struct {
+	// WallTime is the time spent in Next and Series calls, including
+	// the time spent waiting for the inputs of the operator.
+	WallTime time.Duration
+	// CPUTime is the CPU time used by the goroutine which calls Next and Series, including
+	// inputs which it evaluates itself. Inputs which are evaluated by other goroutines, like
+	// the inputs of exchange operators, are not included. It is only measured on Linux.
+	CPUTime time.Duration
+	// NextCalls is the number of Next calls.
+	NextCalls int64
+	// Series is the number of series returned by the operator.
+	Series int64
+	// Samples is the number of float and histogram samples returned by the operator.
+	Samples int64
+}
+
+// Operator is a transparent wrapper which records Stats for the operator it wraps.
+// It is safe for concurrent use if the wrapped operator is.
+//
+// When tracing is enabled, the operator creates a span which covers its execution, with a
+// child span for each Series call. The span of the operator is the parent of the spans of
+// its inputs, and is finished with the aggregated Stats once the operator is exhausted or
+// when Finish is called. Spans are only recorded if the context of the query has a span.
+type Operator struct {
+	next    model.VectorOperator
+	tracing bool
+
+	wallTime  atomic.Int64
+	cpuTime   atomic.Int64
+	nextCalls atomic.Int64
+	series    atomic.Int64
+	samples   atomic.Int64
+
+	spanMu   sync.Mutex
+	span     trace.Span
+	finished bool
+}
+
+// NewOperator wraps next with an Operator. Already wrapped operators are returned unchanged.
+func NewOperator(next model.VectorOperator, enableTracing bool) *Operator {
+	if o, ok := next.(*Operator); ok {
+		o.tracing = o.tracing || enableTracing
+		return o
+	}
+	return &Operator{next: next, tracing: enableTracing}
+}
+
+func (o *Operator) Explain() (me string, next []model.VectorOperator) {
+	return o.next.Explain()
+}
+
+func (o *Operator) GetPool() *model.VectorPool {
+	return o.next.GetPool()
+}
+
+func (o *Operator) Series(ctx context.Context) ([]labels.Labels, error) {
+	defer o.startTimers()()
+
+	// Inputs are called with the context of the operator span, so that their
+	// spans are children of the operator and not of the Series span.
+	ctx = o.spanContext(ctx)
+	span := o.startSpan(ctx, "Series")
+	defer span.End()
+
+	series, err := o.next.Series(ctx)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	o.series.Store(int64(len(series)))
+	span.SetAttributes(attribute.Int("series", len(series)))
+	return series, nil
+}
+
+func (o *Operator) Next(ctx context.Context) ([]model.StepVector, error) {
+	defer o.startTimers()()
+
+	o.nextCalls.Add(1)
+	vectors, err := o.next.Next(o.spanContext(ctx))
+	if err != nil {
+		o.finishSpan(err)
+		return nil, err
+	}
+	if vectors == nil {
+		o.finishSpan(nil)
+		return nil, nil
+	}
+
+	o.samples.Add(int64(model.NumSamples(vectors)))
+	return vectors, nil
+}
+
+// startTimers starts measuring the wall and CPU time of a call and returns the function
+// which records them. The goroutine is locked to its thread during the call, so that the
+// CPU time of the thread is the one used by the goroutine.
+func (o *Operator) startTimers() func() {
+	start := time.Now()
+	runtime.LockOSThread()
+	cpuStart, ok := threadCPUTime()
+	return func() {
+		if cpuEnd, cpuOk := threadCPUTime(); ok && cpuOk {
+			o.cpuTime.Add(int64(cpuEnd - cpuStart))
+		}
+		runtime.UnlockOSThread()
+		o.wallTime.Add(int64(time.Since(start)))
+	}
+}
+
+// Finish finishes the span of the operator if it is still open. It should be called
+// once the query was executed, since operators are not always exhausted.
+func (o *Operator) Finish() {
+	o.finishSpan(nil)
+}
+
+// spanContext returns a context which has the span of the operator as the current span,
+// so that the spans of the inputs become its children. The span is started on first use.
+func (o *Operator) spanContext(ctx context.Context) context.Context {
+	if !o.tracing {
+		return ctx
+	}
+
+	o.spanMu.Lock()
+	defer o.spanMu.Unlock()
+	if o.span == nil {
+		parent := trace.SpanFromContext(ctx)
+		if !parent.IsRecording() {
+			return ctx
+		}
+		me, _ := o.next.Explain()
+		_, o.span = parent.TracerProvider().Tracer(tracerName).Start(ctx, operatorName(o.next),
+			trace.WithAttributes(attribute.String("operator", me)),
+		)
+	}
+	return trace.ContextWithSpan(ctx, o.span)
+}
+
+// startSpan starts a child of the current span in the context.
+func (o *Operator) startSpan(ctx context.Context, name string) trace.Span {
+	if !o.tracing {
+		return trace.SpanFromContext(context.Background())
+	}
+	_, span := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name)
+	return span
+}
+
+func (o *Operator) finishSpan(err error) {
+	if !o.tracing {
+		return
+	}
+
+	o.spanMu.Lock()
+	defer o.spanMu.Unlock()
+	if o.span == nil || o.finished {
+		return
+	}
+	o.finished = true
+
+	stats := o.Stats()
+	o.span.SetAttributes(
+		attribute.Int64("next_calls", stats.NextCalls),
+		attribute.Int64("series", stats.Series),
+		attribute.Int64("samples", stats.Samples),
+		attribute.String("wall_time", stats.WallTime.String()),
+		attribute.String("cpu_time", stats.CPUTime.String()),
+	)
+	if err != nil {
+		o.span.SetStatus(codes.Error, err.Error())
+	}
+	o.span.End()
+}
+
+// operatorName returns the name of the operator type without the package, e.g. "vectorSelector".
+func operatorName(op model.VectorOperator) string {
+	name := fmt.Sprintf("%T", op)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// Stats returns the statistics recorded so far.
+func (o *Operator) Stats() Stats {
+	return Stats{
+		WallTime:  time.Duration(o.wallTime.Load()),
+		CPUTime:   time.Duration(o.cpuTime.Load()),
+		NextCalls: o.nextCalls.Load(),
+		Series:    o.series.Load(),
+		Samples:   o.samples.Load(),
+	}
+}
@@ -20,7 +20,7 @@ type unaryNegation struct {
 
 	series []labels.Labels
 
-	workers worker.Group
+	workers *worker.Group
 }
 
 func (u *unaryNegation) Explain() (me string, next []model.VectorOperator) {
@@ -30,12 +30,13 @@ func (u *unaryNegation) Explain() (me string, next []model.VectorOperator) {
 func NewUnaryNegation(
 	next model.VectorOperator,
 	stepsBatch int,
+	parallelism int,
 ) (model.VectorOperator, error) {
 	u := &unaryNegation{
 		next: next,
 	}
 
-	u.workers = worker.NewGroup(stepsBatch, u.workerTask)
+	u.workers = worker.NewGroup(stepsBatch, parallelism, u.workerTask)
 	return u, nil
 }
 
@@ -74,6 +75,13 @@ func (u *unaryNegation) Next(ctx context.Context) ([]model.StepVector, error) {
 	default:
 	}
 
+	// The workers are started when series are loaded, which parents might not have done yet.
+	var err error
+	u.once.Do(func() { err = u.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
 	in, err := u.next.Next(ctx)
 	if err != nil {
 		return nil, err
@@ -82,7 +90,7 @@ func (u *unaryNegation) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, nil
 	}
 	for i, vector := range in {
-		if err := u.workers[i].Send(0, vector); err != nil {
+		if err := u.workers.Send(i, 0, vector); err != nil {
 			return nil, err
 		}
 	}
@@ -90,7 +98,7 @@ func (u *unaryNegation) Next(ctx context.Context) ([]model.StepVector, error) {
 	for i := range in {
 		// Make sure worker finishes the job.
 		// Since it is in-place so no need another buffer.
-		if _, err := u.workers[i].GetOutput(); err != nil {
+		if _, err := u.workers.GetOutput(i); err != nil {
 			return nil, err
 		}
 	}
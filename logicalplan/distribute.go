@@ -5,10 +5,16 @@ package logicalplan
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/thanos-community/promql-engine/api"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 type Coalesce struct {
@@ -27,6 +33,27 @@ func (r Coalesce) Type() parser.ValueType { return parser.ValueTypeMatrix }
 
 func (r Coalesce) PromQLExpr() {}
 
+// Deduplicate is a set of expressions which are executed by replicas of the same
+// remote engine. Their results are merged into a single copy of each series.
+type Deduplicate struct {
+	Expressions parser.Expressions
+	// ReplicaLabels are the labels which identify the replica of a series,
+	// and which are removed from the merged series.
+	ReplicaLabels []string
+}
+
+func (r Deduplicate) String() string {
+	return fmt.Sprintf("dedup(%s)", r.Expressions)
+}
+
+func (r Deduplicate) Pretty(level int) string { return r.String() }
+
+func (r Deduplicate) PositionRange() parser.PositionRange { return parser.PositionRange{} }
+
+func (r Deduplicate) Type() parser.ValueType { return parser.ValueTypeMatrix }
+
+func (r Deduplicate) PromQLExpr() {}
+
 type RemoteExecution struct {
 	Engine api.RemoteEngine
 	Query  string
@@ -44,23 +71,35 @@ func (r RemoteExecution) Type() parser.ValueType { return parser.ValueTypeMatrix
 
 func (r RemoteExecution) PromQLExpr() {}
 
-var distributiveAggregations = map[parser.ItemType]struct{}{
-	parser.SUM:     {},
-	parser.MIN:     {},
-	parser.MAX:     {},
-	parser.GROUP:   {},
-	parser.COUNT:   {},
-	parser.BOTTOMK: {},
-	parser.TOPK:    {},
+// distributiveAggregations are aggregations which are executed by remote engines, and whose
+// results are merged locally with the aggregation of the value.
+var distributiveAggregations = map[parser.ItemType]parser.ItemType{
+	parser.SUM:     parser.SUM,
+	parser.MIN:     parser.MIN,
+	parser.MAX:     parser.MAX,
+	parser.GROUP:   parser.GROUP,
+	parser.COUNT:   parser.SUM,
+	parser.BOTTOMK: parser.BOTTOMK,
+	parser.TOPK:    parser.TOPK,
+}
+
+// decomposableAggregations are aggregations which are calculated locally
+// from the results of distributive aggregations.
+var decomposableAggregations = map[parser.ItemType]struct{}{
+	parser.AVG: {},
 }
 
 // DistributedExecutionOptimizer produces a logical plan suitable for
 // distributed Query execution.
 type DistributedExecutionOptimizer struct {
 	Endpoints api.RemoteEndpoints
+	// ReplicaLabels are the external labels which identify replicas of the same data.
+	// Engines with the same label sets after removing the replica labels are treated
+	// as replicas, and their results are deduplicated.
+	ReplicaLabels []string
 }
 
-func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr) parser.Expr {
+func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr, opts *query.Options) parser.Expr {
 	engines := m.Endpoints.Engines()
 	traverseBottomUp(nil, &plan, func(parent, current *parser.Expr) (stop bool) {
 		// If the current operation is not distributive, stop the traversal.
@@ -71,19 +110,7 @@ func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr) parser.Expr {
 		// If the current node is an aggregation, distribute the operation and
 		// stop the traversal.
 		if aggr, ok := (*current).(*parser.AggregateExpr); ok {
-			localAggregation := aggr.Op
-			if aggr.Op == parser.COUNT {
-				localAggregation = parser.SUM
-			}
-			subQueries := m.makeSubQueries(current, engines)
-			*current = &parser.AggregateExpr{
-				Op:       localAggregation,
-				Expr:     subQueries,
-				Param:    aggr.Param,
-				Grouping: aggr.Grouping,
-				Without:  aggr.Without,
-				PosRange: aggr.PosRange,
-			}
+			*current = m.distributeAggregation(aggr, engines, opts)
 			return true
 		}
 
@@ -92,26 +119,239 @@ func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr) parser.Expr {
 			return false
 		}
 
-		*current = m.makeSubQueries(current, engines)
+		*current = m.makeSubQueries(current, engines, opts)
 		return true
 	})
 
 	return plan
 }
 
-func (m DistributedExecutionOptimizer) makeSubQueries(current *parser.Expr, engines []api.RemoteEngine) Coalesce {
+// distributeAggregation rewrites the aggregation into aggregations which are executed by remote
+// engines, and which are merged locally.
+func (m DistributedExecutionOptimizer) distributeAggregation(aggr *parser.AggregateExpr, engines []api.RemoteEngine, opts *query.Options) parser.Expr {
+	if aggr.Op == parser.AVG {
+		// avg(x) = sum(x) / count(x)
+		return &parser.ParenExpr{Expr: &parser.BinaryExpr{
+			Op:             parser.DIV,
+			LHS:            m.distributeAggregationOp(parser.SUM, aggr, engines, opts),
+			RHS:            m.distributeAggregationOp(parser.COUNT, aggr, engines, opts),
+			VectorMatching: &parser.VectorMatching{Card: parser.CardOneToOne},
+		}}
+	}
+	return m.distributeAggregationOp(aggr.Op, aggr, engines, opts)
+}
+
+// distributeAggregationOp executes the aggregation op, with the operand, grouping and
+// parameter of aggr, in remote engines and merges the results locally.
+func (m DistributedExecutionOptimizer) distributeAggregationOp(op parser.ItemType, aggr *parser.AggregateExpr, engines []api.RemoteEngine, opts *query.Options) parser.Expr {
+	var remoteAggr parser.Expr = &parser.AggregateExpr{
+		Op:       op,
+		Expr:     aggr.Expr,
+		Param:    aggr.Param,
+		Grouping: aggr.Grouping,
+		Without:  aggr.Without,
+		PosRange: aggr.PosRange,
+	}
+	return &parser.AggregateExpr{
+		Op:       distributiveAggregations[op],
+		Expr:     m.makeSubQueries(&remoteAggr, engines, opts),
+		Param:    aggr.Param,
+		Grouping: aggr.Grouping,
+		Without:  aggr.Without,
+		PosRange: aggr.PosRange,
+	}
+}
+
+func (m DistributedExecutionOptimizer) makeSubQueries(current *parser.Expr, engines []api.RemoteEngine, opts *query.Options) Coalesce {
+	mint, maxt := selectTimeRange(*current, opts)
+	matchers := selectorMatchers(*current)
+
 	remoteQueries := Coalesce{
-		Expressions: make(parser.Expressions, len(engines)),
+		Expressions: make(parser.Expressions, 0, len(engines)),
 	}
-	for i := 0; i < len(engines); i++ {
-		remoteQueries.Expressions[i] = &RemoteExecution{
-			Engine: engines[i],
-			Query:  (*current).String(),
+	var (
+		groups   [][]api.RemoteEngine
+		groupIDs = make(map[string]int)
+		// replicated is set for groups of engines which are identified by their replica labels.
+		replicated []bool
+	)
+	for _, e := range engines {
+		// Engines which do not have data for the selectors of the query can not contribute to its result.
+		if e.MaxT() < mint || e.MinT() > maxt || !matchesLabelSets(e.LabelSets(), matchers) {
+			continue
+		}
+		key, ok := m.replicaGroupKey(e)
+		if !ok {
+			groups = append(groups, []api.RemoteEngine{e})
+			replicated = append(replicated, false)
+			continue
 		}
+		if i, ok := groupIDs[key]; ok {
+			groups[i] = append(groups[i], e)
+			continue
+		}
+		groupIDs[key] = len(groups)
+		groups = append(groups, []api.RemoteEngine{e})
+		replicated = append(replicated, true)
+	}
+
+	for i, group := range groups {
+		replicas := make(parser.Expressions, 0, len(group))
+		for _, e := range group {
+			replicas = append(replicas, &RemoteExecution{
+				Engine: e,
+				Query:  (*current).String(),
+			})
+		}
+		// Groups with a single replica are deduplicated as well, so that replica labels
+		// are removed regardless of how many replicas have data for the query.
+		if !replicated[i] {
+			remoteQueries.Expressions = append(remoteQueries.Expressions, replicas[0])
+			continue
+		}
+		remoteQueries.Expressions = append(remoteQueries.Expressions, Deduplicate{
+			Expressions:   replicas,
+			ReplicaLabels: m.ReplicaLabels,
+		})
 	}
 	return remoteQueries
 }
 
+// replicaGroupKey returns a key which is the same for all replicas of the engine. Engines
+// without label sets can not be identified as replicas, in which case false is returned.
+func (m DistributedExecutionOptimizer) replicaGroupKey(e api.RemoteEngine) (string, bool) {
+	labelSets := e.LabelSets()
+	if len(m.ReplicaLabels) == 0 || len(labelSets) == 0 {
+		return "", false
+	}
+
+	keys := make([]string, 0, len(labelSets))
+	for _, lset := range labelSets {
+		keys = append(keys, labels.NewBuilder(lset).Del(m.ReplicaLabels...).Labels(nil).String())
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ","), true
+}
+
+// selectTimeRange returns the time range of the samples which are selected to evaluate the
+// expression, in the same way as the Prometheus engine calculates it. An expression without
+// selectors has an unbounded time range.
+// Based on https://github.com/prometheus/prometheus/blob/v0.40.1/promql/engine.go#L760.
+func selectTimeRange(expr parser.Expr, opts *query.Options) (int64, int64) {
+	var (
+		mint, maxt int64 = math.MaxInt64, math.MinInt64
+		// Whenever a MatrixSelector is evaluated, evalRange is set to the corresponding range.
+		// The evaluation of the VectorSelector inside then evaluates the given range and unsets
+		// the variable.
+		evalRange time.Duration
+	)
+	inspect(expr, nil, func(node parser.Expr, path []parser.Node) {
+		var vs *parser.VectorSelector
+		switch n := node.(type) {
+		case *parser.MatrixSelector:
+			evalRange = n.Range
+			return
+		case *parser.VectorSelector:
+			vs = n
+		case *FilteredSelector:
+			vs = n.VectorSelector
+		default:
+			return
+		}
+
+		start, end := selectorTimeRange(vs, path, evalRange, opts)
+		if start < mint {
+			mint = start
+		}
+		if end > maxt {
+			maxt = end
+		}
+		evalRange = 0
+	})
+
+	if maxt == math.MinInt64 {
+		return math.MinInt64, math.MaxInt64
+	}
+	return mint, maxt
+}
+
+// Copy from https://github.com/prometheus/prometheus/blob/v0.40.1/promql/engine.go#L793.
+func selectorTimeRange(n *parser.VectorSelector, path []parser.Node, evalRange time.Duration, opts *query.Options) (int64, int64) {
+	start, end := opts.Start.UnixMilli(), opts.End.UnixMilli()
+	subqOffset, subqRange, subqTs := subqueryTimes(path)
+
+	if subqTs != nil {
+		// The timestamp on the subquery overrides the eval statement time ranges.
+		start = *subqTs
+		end = *subqTs
+	}
+
+	if n.Timestamp != nil {
+		// The timestamp on the selector overrides everything.
+		start = *n.Timestamp
+		end = *n.Timestamp
+	} else {
+		start = start - subqOffset.Milliseconds() - subqRange.Milliseconds()
+		end = end - subqOffset.Milliseconds()
+	}
+
+	if evalRange == 0 {
+		start = start - opts.LookbackDelta.Milliseconds()
+	} else {
+		// For all matrix queries we want to ensure that we have (end-start) + range selected
+		// this way we have `range` data before the start time.
+		start = start - evalRange.Milliseconds()
+	}
+
+	start = start - n.OriginalOffset.Milliseconds()
+	end = end - n.OriginalOffset.Milliseconds()
+	return start, end
+}
+
+// selectorMatchers returns the matchers of each selector in the expression.
+func selectorMatchers(expr parser.Expr) [][]*labels.Matcher {
+	var matchers [][]*labels.Matcher
+	inspect(expr, nil, func(node parser.Expr, _ []parser.Node) {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			matchers = append(matchers, n.LabelMatchers)
+		case *FilteredSelector:
+			matchers = append(matchers, append(n.LabelMatchers[:len(n.LabelMatchers):len(n.LabelMatchers)], n.Filters...))
+		}
+	})
+	return matchers
+}
+
+// matchesLabelSets returns true if series with one of the label sets can be selected by one
+// of the selectors with the given matchers. Only matchers for labels in the label set are
+// considered, since other labels of the series are not known. Without label sets, any
+// series can be selected.
+func matchesLabelSets(labelSets []labels.Labels, matchers [][]*labels.Matcher) bool {
+	if len(labelSets) == 0 || len(matchers) == 0 {
+		return true
+	}
+	for _, lset := range labelSets {
+		for _, selectorMatchers := range matchers {
+			if matchesLabelSet(lset, selectorMatchers) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesLabelSet(lset labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !lset.Has(m.Name) {
+			continue
+		}
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
 func isDistributive(expr *parser.Expr) bool {
 	if expr == nil {
 		return false
@@ -123,10 +363,17 @@ func isDistributive(expr *parser.Expr) bool {
 		// the operand is a binary expression.
 		return false
 	case *parser.AggregateExpr:
-		// Certain aggregations are currently not supported.
-		if _, ok := distributiveAggregations[aggr.Op]; !ok {
-			return false
+		// Aggregations like quantile and count_values need all samples of a group. They are
+		// executed locally over the series which are selected from the remote engines.
+		// This includes stddev and stdvar, since merging the variances of remote engines
+		// precisely needs their count and mean for each group as well.
+		if _, ok := distributiveAggregations[aggr.Op]; ok {
+			return true
+		}
+		if _, ok := decomposableAggregations[aggr.Op]; ok {
+			return true
 		}
+		return false
 	}
 
 	return true
@@ -0,0 +1,131 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// OptimizerPass is the logical plan after an optimizer was applied.
+type OptimizerPass struct {
+	// Optimizer is the name of the applied optimizer. It is empty for the plan
+	// before optimization.
+	Optimizer string
+	// Plan is the logical plan printed as a tree with one node per line.
+	Plan string
+}
+
+// Explain optimizes the plan in the same way as Optimize, and additionally
+// returns the plan before optimization and after each optimizer.
+func (p *plan) Explain(optimizers []Optimizer) (Plan, []OptimizerPass) {
+	// Optimizers can modify the expression in place, so the plan has to be
+	// printed before the next optimizer is applied.
+	expr := p.expr
+	passes := make([]OptimizerPass, 0, len(optimizers)+1)
+	passes = append(passes, OptimizerPass{Plan: PrintTree(expr)})
+	for _, o := range optimizers {
+		expr = o.Optimize(expr, p.opts)
+		passes = append(passes, OptimizerPass{
+			Optimizer: reflect.Indirect(reflect.ValueOf(o)).Type().Name(),
+			Plan:      PrintTree(expr),
+		})
+	}
+	return &plan{expr: expr, opts: p.opts}, passes
+}
+
+// PrintTree prints the expression as a tree with one node per line.
+func PrintTree(expr parser.Expr) string {
+	var sb strings.Builder
+	printTree(&sb, expr, "", "")
+	return sb.String()
+}
+
+func printTree(sb *strings.Builder, expr parser.Expr, indent, indentNext string) {
+	me, next := explainNode(expr)
+	sb.WriteString(indent)
+	sb.WriteString(me)
+	sb.WriteString("\n")
+
+	for i, n := range next {
+		if i == len(next)-1 {
+			printTree(sb, n, indentNext+"└── ", indentNext+"    ")
+		} else {
+			printTree(sb, n, indentNext+"├── ", indentNext+"│   ")
+		}
+	}
+}
+
+// explainNode returns the description of a node and its children.
+func explainNode(expr parser.Expr) (string, []parser.Expr) {
+	switch e := expr.(type) {
+	case *parser.AggregateExpr:
+		me := e.Op.String()
+		if e.Without {
+			me += fmt.Sprintf(" without (%s)", strings.Join(e.Grouping, ", "))
+		} else if len(e.Grouping) > 0 {
+			me += fmt.Sprintf(" by (%s)", strings.Join(e.Grouping, ", "))
+		}
+		if e.Param != nil {
+			return me, []parser.Expr{e.Param, e.Expr}
+		}
+		return me, []parser.Expr{e.Expr}
+	case *parser.BinaryExpr:
+		me := e.Op.String()
+		if e.ReturnBool {
+			me += " bool"
+		}
+		if vm := e.VectorMatching; vm != nil && (len(vm.MatchingLabels) > 0 || vm.On) {
+			if vm.On {
+				me += fmt.Sprintf(" on (%s)", strings.Join(vm.MatchingLabels, ", "))
+			} else {
+				me += fmt.Sprintf(" ignoring (%s)", strings.Join(vm.MatchingLabels, ", "))
+			}
+			switch vm.Card {
+			case parser.CardManyToOne:
+				me += fmt.Sprintf(" group_left (%s)", strings.Join(vm.Include, ", "))
+			case parser.CardOneToMany:
+				me += fmt.Sprintf(" group_right (%s)", strings.Join(vm.Include, ", "))
+			}
+		}
+		return me, []parser.Expr{e.LHS, e.RHS}
+	case *parser.Call:
+		return e.Func.Name, e.Args
+	case *parser.MatrixSelector:
+		return fmt.Sprintf("[%s]", model.Duration(e.Range)), []parser.Expr{e.VectorSelector}
+	case *parser.SubqueryExpr:
+		me := fmt.Sprintf("[%s:%s]", model.Duration(e.Range), stepString(e.Step))
+		if e.OriginalOffset > 0 {
+			me += fmt.Sprintf(" offset %s", model.Duration(e.OriginalOffset))
+		}
+		if e.Timestamp != nil {
+			me += fmt.Sprintf(" @ %.3f", float64(*e.Timestamp)/1000.0)
+		}
+		return me, []parser.Expr{e.Expr}
+	case *parser.ParenExpr:
+		return "()", []parser.Expr{e.Expr}
+	case *parser.UnaryExpr:
+		return e.Op.String(), []parser.Expr{e.Expr}
+	case *parser.StepInvariantExpr:
+		return "step_invariant", []parser.Expr{e.Expr}
+	case Coalesce:
+		return "coalesce", e.Expressions
+	case Deduplicate:
+		return "dedup", e.Expressions
+	default:
+		return expr.String(), nil
+	}
+}
+
+func stepString(step time.Duration) string {
+	if step == 0 {
+		return ""
+	}
+	return model.Duration(step).String()
+}
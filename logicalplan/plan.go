@@ -4,10 +4,13 @@
 package logicalplan
 
 import (
+	"math"
 	"time"
 
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/query"
 )
 
 var (
@@ -22,32 +25,35 @@ var DefaultOptimizers = []Optimizer{
 
 type Plan interface {
 	Optimize([]Optimizer) Plan
+	Explain([]Optimizer) (Plan, []OptimizerPass)
 	Expr() parser.Expr
 }
 
 type Optimizer interface {
-	Optimize(parser.Expr) parser.Expr
+	Optimize(plan parser.Expr, opts *query.Options) parser.Expr
 }
 
 type plan struct {
 	expr parser.Expr
+	opts *query.Options
 }
 
-func New(expr parser.Expr, mint, maxt time.Time) Plan {
-	expr = promql.PreprocessExpr(expr, mint, maxt)
-	setOffsetForAtModifier(mint.UnixMilli(), expr)
+func New(expr parser.Expr, opts *query.Options) Plan {
+	expr = promql.PreprocessExpr(expr, opts.Start, opts.End)
+	SetOffsetForAtModifier(opts.Start.UnixMilli(), expr)
 
 	return &plan{
 		expr: expr,
+		opts: opts,
 	}
 }
 
 func (p *plan) Optimize(optimizers []Optimizer) Plan {
 	for _, o := range optimizers {
-		p.expr = o.Optimize(p.expr)
+		p.expr = o.Optimize(p.expr, p.opts)
 	}
 
-	return &plan{p.expr}
+	return &plan{expr: p.expr, opts: p.opts}
 }
 
 func (p *plan) Expr() parser.Expr {
@@ -96,8 +102,8 @@ func traverseBottomUp(parent *parser.Expr, current *parser.Expr, transform func(
 		}
 		return transform(parent, current)
 	case *parser.Call:
-		for _, n := range node.Args {
-			if stop := traverseBottomUp(current, &n, transform); stop {
+		for i := range node.Args {
+			if stop := traverseBottomUp(current, &node.Args[i], transform); stop {
 				return stop
 			}
 		}
@@ -120,31 +126,109 @@ func traverseBottomUp(parent *parser.Expr, current *parser.Expr, transform func(
 	return true
 }
 
-// Copy from https://github.com/prometheus/prometheus/blob/v2.39.1/promql/engine.go#L2658.
-func setOffsetForAtModifier(evalTime int64, expr parser.Expr) {
+// SetOffsetForAtModifier modifies the offset of vector and matrix selectors
+// and subqueries in the tree to accommodate the timestamp of the @ modifier.
+// The offset is adjusted w.r.t. the given evaluation time.
+// Copy from https://github.com/prometheus/prometheus/blob/v0.40.1/promql/engine.go#L2762.
+func SetOffsetForAtModifier(evalTime int64, expr parser.Expr) {
 	getOffset := func(ts *int64, originalOffset time.Duration, path []parser.Node) time.Duration {
 		if ts == nil {
 			return originalOffset
 		}
-		// TODO: support subquery.
+
+		subqOffset, _, subqTs := subqueryTimes(path)
+		if subqTs != nil {
+			subqOffset += time.Duration(evalTime-*subqTs) * time.Millisecond
+		}
 
 		offsetForTs := time.Duration(evalTime-*ts) * time.Millisecond
-		offsetDiff := offsetForTs
+		offsetDiff := offsetForTs - subqOffset
 		return originalOffset + offsetDiff
 	}
 
-	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+	inspect(expr, nil, func(node parser.Expr, path []parser.Node) {
 		switch n := node.(type) {
 		case *parser.VectorSelector:
 			n.Offset = getOffset(n.Timestamp, n.OriginalOffset, path)
 
-		case *parser.MatrixSelector:
-			vs := n.VectorSelector.(*parser.VectorSelector)
-			vs.Offset = getOffset(vs.Timestamp, vs.OriginalOffset, path)
+		case *FilteredSelector:
+			n.Offset = getOffset(n.Timestamp, n.OriginalOffset, path)
 
 		case *parser.SubqueryExpr:
 			n.Offset = getOffset(n.Timestamp, n.OriginalOffset, path)
 		}
-		return nil
 	})
 }
+
+// subqueryTimes returns the sum of offsets and ranges of all subqueries in the path.
+// If the @ modifier is used, then the offset and range is w.r.t. that timestamp
+// (i.e. the sum is reset when we have @ modifier).
+// The returned *int64 is the closest timestamp that was seen. nil for no @ modifier.
+// Copy from https://github.com/prometheus/prometheus/blob/v0.40.1/promql/engine.go#L734.
+func subqueryTimes(path []parser.Node) (time.Duration, time.Duration, *int64) {
+	var (
+		subqOffset, subqRange time.Duration
+		ts                    int64 = math.MaxInt64
+	)
+	for _, node := range path {
+		switch n := node.(type) {
+		case *parser.SubqueryExpr:
+			subqOffset += n.OriginalOffset
+			subqRange += n.Range
+			if n.Timestamp != nil {
+				// The @ modifier on subquery invalidates all the offset and
+				// range till now. Hence resetting it here.
+				subqOffset = n.OriginalOffset
+				subqRange = n.Range
+				ts = *n.Timestamp
+			}
+		}
+	}
+	var tsp *int64
+	if ts != math.MaxInt64 {
+		tsp = &ts
+	}
+	return subqOffset, subqRange, tsp
+}
+
+// inspect calls f for each node in the expression tree together with the path
+// of its ancestors. Unlike parser.Inspect, it also descends into nodes which
+// are specific to the logical plan.
+func inspect(expr parser.Expr, path []parser.Node, f func(node parser.Expr, path []parser.Node)) {
+	if expr == nil {
+		return
+	}
+	f(expr, path)
+
+	path = append(path, expr)
+	switch node := expr.(type) {
+	case *parser.StepInvariantExpr:
+		inspect(node.Expr, path, f)
+	case *parser.MatrixSelector:
+		inspect(node.VectorSelector, path, f)
+	case *parser.AggregateExpr:
+		inspect(node.Param, path, f)
+		inspect(node.Expr, path, f)
+	case *parser.Call:
+		for _, arg := range node.Args {
+			inspect(arg, path, f)
+		}
+	case *parser.BinaryExpr:
+		inspect(node.LHS, path, f)
+		inspect(node.RHS, path, f)
+	case *parser.UnaryExpr:
+		inspect(node.Expr, path, f)
+	case *parser.ParenExpr:
+		inspect(node.Expr, path, f)
+	case *parser.SubqueryExpr:
+		inspect(node.Expr, path, f)
+	case Coalesce:
+		for _, e := range node.Expressions {
+			inspect(e, path, f)
+		}
+	case Deduplicate:
+		for _, e := range node.Expressions {
+			inspect(e, path, f)
+		}
+	}
+}
@@ -4,14 +4,17 @@
 package logicalplan
 
 import (
+	"math"
 	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/thanos-community/promql-engine/api"
+	"github.com/thanos-community/promql-engine/query"
 
 	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 )
 
@@ -87,7 +90,7 @@ func TestDefaultOptimizers(t *testing.T) {
 			expr, err := parser.ParseExpr(tcase.expr)
 			testutil.Ok(t, err)
 
-			plan := New(expr, time.Unix(0, 0), time.Unix(0, 0))
+			plan := New(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
 			optimizedPlan := plan.Optimize(DefaultOptimizers)
 			expectedPlan := strings.Trim(spaces.ReplaceAllString(tcase.expected, " "), " ")
 			testutil.Equals(t, expectedPlan, optimizedPlan.Expr().String())
@@ -129,7 +132,7 @@ func TestMatcherPropagation(t *testing.T) {
 			expr, err := parser.ParseExpr(tcase.expr)
 			testutil.Ok(t, err)
 
-			plan := New(expr, time.Unix(0, 0), time.Unix(0, 0))
+			plan := New(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
 			optimizedPlan := plan.Optimize(optimizers)
 			expectedPlan := strings.Trim(spaces.ReplaceAllString(tcase.expected, " "), " ")
 			testutil.Equals(t, expectedPlan, optimizedPlan.Expr().String())
@@ -158,12 +161,75 @@ sum by (pod) (
 			name: "avg",
 			expr: `avg by (pod) (http_requests_total)`,
 			expected: `
-avg by (pod) (
+(
+  sum by (pod) (
+    coalesce(
+      remote(sum by (pod) (http_requests_total)),
+      remote(sum by (pod) (http_requests_total))
+    )
+  )
+  /
+  sum by (pod) (
+    coalesce(
+      remote(count by (pod) (http_requests_total)),
+      remote(count by (pod) (http_requests_total))
+    )
+  )
+)`,
+		},
+		{
+			name: "stdvar",
+			expr: `stdvar without (pod) (http_requests_total)`,
+			expected: `
+stdvar without (pod) (
+  coalesce(
+    remote(http_requests_total),
+    remote(http_requests_total)
+  )
+)`,
+		},
+		{
+			name: "stddev",
+			expr: `stddev by (pod) (rate(http_requests_total[5m]))`,
+			expected: `
+stddev by (pod) (
+  coalesce(
+    remote(rate(http_requests_total[5m])),
+    remote(rate(http_requests_total[5m]))
+  )
+)`,
+		},
+		{
+			name: "quantile",
+			expr: `quantile by (pod) (0.9, http_requests_total)`,
+			expected: `
+quantile by (pod) (0.9,
+  coalesce(
+    remote(http_requests_total),
+    remote(http_requests_total)
+  )
+)`,
+		},
+		{
+			name: "count_values",
+			expr: `count_values by (pod) ("value", http_requests_total)`,
+			expected: `
+count_values by (pod) ("value",
   coalesce(
     remote(http_requests_total),
     remote(http_requests_total)
   )
 )`,
+		},
+		{
+			name: "avg in the operand path",
+			expr: `max by (pod) (sort(avg(http_requests_total)))`,
+			expected: `
+max by (pod) (sort((
+  sum(coalesce(remote(sum(http_requests_total)), remote(sum(http_requests_total))))
+  /
+  sum(coalesce(remote(count(http_requests_total)), remote(count(http_requests_total))))
+)))`,
 		},
 		{
 			name: "two-level aggregation",
@@ -191,9 +257,9 @@ max by (pod) (
 		},
 		{
 			name: "unsupported aggregation in the operand path",
-			expr: `max by (pod) (sort(avg(http_requests_total)))`,
+			expr: `max by (pod) (sort(quantile(0.9, http_requests_total)))`,
 			expected: `
-max by (pod) (sort(avg(
+max by (pod) (sort(quantile(0.9,
   coalesce(
     remote(http_requests_total),
     remote(http_requests_total)
@@ -234,7 +300,10 @@ coalesce(
 		},
 	}
 
-	engines := make([]api.RemoteEngine, 2)
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, nil),
+		newEngineMock(math.MinInt64, math.MaxInt64, nil),
+	}
 	optimizers := []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)}}
 	replacements := map[string]*regexp.Regexp{
 		" ": spaces,
@@ -247,7 +316,7 @@ coalesce(
 			expr, err := parser.ParseExpr(tcase.expr)
 			testutil.Ok(t, err)
 
-			plan := New(expr, time.Unix(0, 0), time.Unix(0, 0))
+			plan := New(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
 			optimizedPlan := plan.Optimize(optimizers)
 			expectedPlan := cleanUp(replacements, tcase.expected)
 			testutil.Equals(t, expectedPlan, optimizedPlan.Expr().String())
@@ -255,9 +324,254 @@ coalesce(
 	}
 }
 
+func TestDistributedExecutionWithReplicas(t *testing.T) {
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east", "replica", "a")}),
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "west", "replica", "a")}),
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east", "replica", "b")}),
+	}
+	replacements := map[string]*regexp.Regexp{
+		" ": spaces,
+		"(": openParenthesis,
+		")": closedParenthesis,
+	}
+
+	cases := []struct {
+		name          string
+		expr          string
+		replicaLabels []string
+		expected      string
+	}{
+		{
+			name:          "replicas",
+			expr:          `sum by (pod) (http_requests_total)`,
+			replicaLabels: []string{"replica"},
+			expected: `
+sum by (pod) (
+  coalesce(
+    dedup(
+      remote(sum by (pod) (http_requests_total)),
+      remote(sum by (pod) (http_requests_total))
+    ),
+    dedup(
+      remote(sum by (pod) (http_requests_total))
+    )
+  )
+)`,
+		},
+		{
+			name:          "pruned replicas",
+			expr:          `sum by (pod) (http_requests_total{region="west"})`,
+			replicaLabels: []string{"replica"},
+			expected:      `sum by (pod) (coalesce(dedup(remote(sum by (pod) (http_requests_total{region="west"})))))`,
+		},
+		{
+			name: "no replica labels",
+			expr: `sum by (pod) (http_requests_total)`,
+			expected: `
+sum by (pod) (
+  coalesce(
+    remote(sum by (pod) (http_requests_total)),
+    remote(sum by (pod) (http_requests_total)),
+    remote(sum by (pod) (http_requests_total))
+  )
+)`,
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			optimizers := []Optimizer{DistributedExecutionOptimizer{
+				Endpoints:     api.NewStaticEndpoints(engines),
+				ReplicaLabels: tcase.replicaLabels,
+			}}
+			plan := New(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			expectedPlan := cleanUp(replacements, tcase.expected)
+			testutil.Equals(t, expectedPlan, optimizedPlan.Expr().String())
+		})
+	}
+}
+
+func TestDistributedExecutionPruning(t *testing.T) {
+	hour := time.Hour.Milliseconds()
+	engines := []api.RemoteEngine{
+		// Recent data of the east region.
+		newEngineMock(10*hour, 12*hour, []labels.Labels{labels.FromStrings("region", "east")}),
+		// Recent data of the west region, replicated in two zones.
+		newEngineMock(10*hour, 12*hour, []labels.Labels{
+			labels.FromStrings("region", "west", "zone", "a"),
+			labels.FromStrings("region", "west", "zone", "b"),
+		}),
+		// Long-term storage of all regions.
+		newEngineMock(0, 11*hour, nil),
+	}
+	optimizers := []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)}}
+
+	cases := []struct {
+		name     string
+		expr     string
+		start    time.Time
+		end      time.Time
+		expected []api.RemoteEngine
+	}{
+		{
+			name:     "all engines",
+			expr:     `sum(http_requests_total)`,
+			start:    time.UnixMilli(10 * hour),
+			end:      time.UnixMilli(11 * hour),
+			expected: engines,
+		},
+		{
+			name:     "recent data",
+			expr:     `sum(http_requests_total)`,
+			start:    time.UnixMilli(11*hour + time.Hour.Milliseconds()/2),
+			end:      time.UnixMilli(12 * hour),
+			expected: engines[:2],
+		},
+		{
+			name:     "old data",
+			expr:     `sum(http_requests_total)`,
+			start:    time.UnixMilli(5 * hour),
+			end:      time.UnixMilli(6 * hour),
+			expected: engines[2:],
+		},
+		{
+			name:     "range of matrix selector",
+			expr:     `sum(rate(http_requests_total[2h]))`,
+			start:    time.UnixMilli(12 * hour),
+			end:      time.UnixMilli(12 * hour),
+			expected: engines,
+		},
+		{
+			name:     "offset",
+			expr:     `sum(http_requests_total offset 6h)`,
+			start:    time.UnixMilli(11*hour + time.Hour.Milliseconds()/2),
+			end:      time.UnixMilli(12 * hour),
+			expected: engines[2:],
+		},
+		{
+			name:     "external label matcher",
+			expr:     `sum(http_requests_total{region="west"})`,
+			start:    time.UnixMilli(10 * hour),
+			end:      time.UnixMilli(11 * hour),
+			expected: engines[1:],
+		},
+		{
+			name:     "external label matchers not matching any label set",
+			expr:     `sum(http_requests_total{region="west", zone="c"})`,
+			start:    time.UnixMilli(10 * hour),
+			end:      time.UnixMilli(11 * hour),
+			expected: engines[2:],
+		},
+		{
+			name:     "no engines",
+			expr:     `sum(http_requests_total{region="north"})`,
+			start:    time.UnixMilli(11*hour + time.Hour.Milliseconds()/2),
+			end:      time.UnixMilli(12 * hour),
+			expected: []api.RemoteEngine{},
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			opts := &query.Options{Start: tcase.start, End: tcase.end, Step: time.Minute, LookbackDelta: 5 * time.Minute}
+			optimizedPlan := New(expr, opts).Optimize(optimizers)
+
+			remoteEngines := []api.RemoteEngine{}
+			for _, e := range optimizedPlan.Expr().(*parser.AggregateExpr).Expr.(Coalesce).Expressions {
+				remoteEngines = append(remoteEngines, e.(*RemoteExecution).Engine)
+			}
+			testutil.Equals(t, tcase.expected, remoteEngines)
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	expr, err := parser.ParseExpr(`sum by (pod) (http_requests_total{pod="nginx-1"} - http_responses_total)`)
+	testutil.Ok(t, err)
+
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, nil),
+		newEngineMock(math.MinInt64, math.MaxInt64, nil),
+	}
+	optimizers := []Optimizer{
+		PropagateMatchersOptimizer{},
+		DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)},
+	}
+	plan, passes := New(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}).Explain(optimizers)
+
+	expected := []OptimizerPass{
+		{
+			Plan: `sum by (pod)
+└── -
+    ├── http_requests_total{pod="nginx-1"}
+    └── http_responses_total
+`,
+		},
+		{
+			Optimizer: "PropagateMatchersOptimizer",
+			Plan: `sum by (pod)
+└── -
+    ├── http_requests_total{pod="nginx-1"}
+    └── http_responses_total{pod="nginx-1"}
+`,
+		},
+		{
+			Optimizer: "DistributedExecutionOptimizer",
+			Plan: `sum by (pod)
+└── -
+    ├── coalesce
+    │   ├── remote(http_requests_total{pod="nginx-1"})
+    │   └── remote(http_requests_total{pod="nginx-1"})
+    └── coalesce
+        ├── remote(http_responses_total{pod="nginx-1"})
+        └── remote(http_responses_total{pod="nginx-1"})
+`,
+		},
+	}
+	testutil.Equals(t, expected, passes)
+	testutil.Equals(t, PrintTree(plan.Expr()), passes[len(passes)-1].Plan)
+
+	expr, err = parser.ParseExpr(`max without (pod) (rate(http_requests_total[2m] offset 1m)) > bool on (namespace) group_right (pod) -quantile_over_time(0.9, http_requests_total[5m:1m])`)
+	testutil.Ok(t, err)
+	testutil.Equals(t, `> bool on (namespace) group_right (pod)
+├── max without (pod)
+│   └── rate
+│       └── [2m]
+│           └── http_requests_total offset 1m
+└── -
+    └── quantile_over_time
+        ├── 0.9
+        └── [5m:1m]
+            └── http_requests_total
+`, PrintTree(expr))
+}
+
 func cleanUp(replacements map[string]*regexp.Regexp, expr string) string {
 	for replacement, match := range replacements {
 		expr = match.ReplaceAllString(expr, replacement)
 	}
 	return strings.Trim(expr, " ")
 }
+
+type engineMock struct {
+	api.RemoteEngine
+	minT      int64
+	maxT      int64
+	labelSets []labels.Labels
+}
+
+func newEngineMock(minT, maxT int64, labelSets []labels.Labels) *engineMock {
+	return &engineMock{minT: minT, maxT: maxT, labelSets: labelSets}
+}
+
+func (e engineMock) MinT() int64 { return e.minT }
+
+func (e engineMock) MaxT() int64 { return e.maxT }
+
+func (e engineMock) LabelSets() []labels.Labels { return e.labelSets }
@@ -0,0 +1,60 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+// SampleLimiter limits the number of samples which a query keeps in memory at the same time.
+// Operators reserve samples with Add when they load or produce them, and release them with
+// Remove once they are consumed. Samples which are part of the query result are never released,
+// which mirrors how the Prometheus engine accounts for samples.
+// The limiter also records the highest number of samples which were held at the same time.
+// It is safe for concurrent use, and all methods can be called on a nil limiter.
+type SampleLimiter struct {
+	maxSamples int64
+	current    atomic.Int64
+	peak       atomic.Int64
+}
+
+// NewSampleLimiter creates a limiter which allows at most maxSamples samples
+// to be held in memory. A non-positive limit only disables limiting, the peak
+// number of samples is still recorded.
+func NewSampleLimiter(maxSamples int) *SampleLimiter {
+	return &SampleLimiter{maxSamples: int64(maxSamples)}
+}
+
+// Add reserves n samples and returns promql.ErrTooManySamples if the limit was exceeded.
+func (l *SampleLimiter) Add(n int) error {
+	if l == nil || n == 0 {
+		return nil
+	}
+	current := l.current.Add(int64(n))
+	for peak := l.peak.Load(); current > peak && !l.peak.CompareAndSwap(peak, current); {
+		peak = l.peak.Load()
+	}
+	if l.maxSamples > 0 && current > l.maxSamples {
+		return promql.ErrTooManySamples("query execution")
+	}
+	return nil
+}
+
+// Remove releases n samples which were previously reserved.
+func (l *SampleLimiter) Remove(n int) {
+	if l == nil || n == 0 {
+		return
+	}
+	l.current.Add(-int64(n))
+}
+
+// Peak returns the highest number of samples which were held at the same time.
+func (l *SampleLimiter) Peak() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.peak.Load()
+}
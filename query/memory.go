@@ -0,0 +1,116 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// ErrMemoryLimitExceeded is returned by queries which allocate more memory than their limit.
+var ErrMemoryLimitExceeded = errors.New("query memory limit exceeded")
+
+// MemoryTracker accounts for the memory which is held by vector pools and
+// selectors while a query is executed. Buffers are reported when they are taken
+// and freed when they are released, so the limit applies to the memory which is
+// in use at any point of the execution, and not to the total allocations of the query.
+// It is safe for concurrent use, and all methods can be called on a nil tracker.
+type MemoryTracker struct {
+	limit     int64
+	allocated atomic.Int64
+	peak      atomic.Int64
+
+	mu     sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+// NewMemoryTracker creates a tracker which fails the query once it holds
+// more than limit bytes. A non-positive limit only tracks allocations.
+func NewMemoryTracker(limit int64) *MemoryTracker {
+	return &MemoryTracker{limit: limit}
+}
+
+// SetCancelFunc sets the function which is called to cancel the query when the limit is exceeded.
+// It is needed because allocations can happen in places which can not return errors.
+func (m *MemoryTracker) SetCancelFunc(cancel context.CancelFunc) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cancel = cancel
+	if m.err != nil {
+		cancel()
+	}
+}
+
+// Alloc records that n bytes were allocated. If the limit is exceeded, the query is
+// cancelled and an error wrapping ErrMemoryLimitExceeded is returned.
+func (m *MemoryTracker) Alloc(n int) error {
+	if m == nil || n == 0 {
+		return nil
+	}
+	allocated := m.allocated.Add(int64(n))
+	for peak := m.peak.Load(); allocated > peak; peak = m.peak.Load() {
+		if m.peak.CompareAndSwap(peak, allocated) {
+			break
+		}
+	}
+	if m.limit <= 0 || allocated <= m.limit {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = errors.Wrapf(ErrMemoryLimitExceeded, "query needs more than %d bytes", m.limit)
+		if m.cancel != nil {
+			m.cancel()
+		}
+	}
+	return m.err
+}
+
+// Free records that n bytes which were reported with Alloc are released. Freeing more
+// bytes than were allocated is a bug in the accounting of the query, which fails the
+// query with an error instead of silently distorting the tracked memory.
+func (m *MemoryTracker) Free(n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	if m.allocated.Add(-int64(n)) >= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = errors.Newf("memory tracker released %d bytes more than were allocated", -m.allocated.Load())
+		if m.cancel != nil {
+			m.cancel()
+		}
+	}
+}
+
+// Err returns the error of the exceeded limit or of a broken accounting, or nil if the query is within its limit.
+func (m *MemoryTracker) Err() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// PeakBytes returns the highest number of bytes which were held by the query at once.
+func (m *MemoryTracker) PeakBytes() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.peak.Load()
+}
@@ -8,12 +8,33 @@ import (
 )
 
 type Options struct {
-	Start         time.Time
-	End           time.Time
-	Step          time.Duration
-	LookbackDelta time.Duration
+	Start                    time.Time
+	End                      time.Time
+	Step                     time.Duration
+	LookbackDelta            time.Duration
+	NoStepSubqueryIntervalFn func(time.Duration) time.Duration
 
 	StepsBatch int64
+	// Parallelism is the maximum number of shards and workers which
+	// an operator of the query uses to process data concurrently.
+	Parallelism int
+
+	// SampleTracker collects the number of samples selected by the query.
+	SampleTracker *SampleTracker
+	// SampleLimiter limits the number of samples the query can hold in memory.
+	SampleLimiter *SampleLimiter
+	// MemoryTracker accounts for the memory held by the query.
+	MemoryTracker *MemoryTracker
+	// Warnings collects the warnings which are returned with the result of the query.
+	Warnings *Warnings
+
+	// EnableAnalysis enables recording execution statistics for each operator.
+	EnableAnalysis bool
+	// EnableTracing enables creating a tracing span for each operator.
+	EnableTracing bool
+	// EnablePartialResponse turns failures of remote executions into warnings,
+	// and the query returns the data of the remaining remote engines.
+	EnablePartialResponse bool
 }
 
 func (o *Options) NumSteps() int {
@@ -29,6 +50,11 @@ func (o *Options) NumSteps() int {
 	return int(totalSteps)
 }
 
+// IsInstantQuery returns true if the query is evaluated at a single timestamp.
+func (o *Options) IsInstantQuery() bool {
+	return o.Start.Equal(o.End)
+}
+
 func (o *Options) WithEndTime(end time.Time) *Options {
 	result := *o
 	result.End = end
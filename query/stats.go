@@ -0,0 +1,114 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/util/stats"
+)
+
+// SampleTracker counts the samples and series which operators select while evaluating a query.
+// It is safe for concurrent use, and all methods can be called on a nil tracker.
+type SampleTracker struct {
+	start int64
+	step  int64
+
+	mu      sync.Mutex
+	total   int64
+	perStep []int64
+	series  int64
+}
+
+// NewSampleTracker creates a tracker for a query with the given time range and step.
+func NewSampleTracker(start, end time.Time, step time.Duration) *SampleTracker {
+	stepMillis := step.Milliseconds()
+	numSteps := 1
+	if stepMillis > 0 {
+		numSteps = int((end.UnixMilli()-start.UnixMilli())/stepMillis) + 1
+	}
+	return &SampleTracker{
+		start:   start.UnixMilli(),
+		step:    stepMillis,
+		perStep: make([]int64, numSteps),
+	}
+}
+
+// AddSamplesAtTimestamp records that n samples were selected for the step with timestamp t.
+// Timestamps outside of the query range, like the ones of subquery steps, are
+// attributed to the closest step of the query.
+func (s *SampleTracker) AddSamplesAtTimestamp(t int64, n int) {
+	if s == nil || n == 0 {
+		return
+	}
+	i := 0
+	if s.step > 0 && t > s.start {
+		i = int((t - s.start) / s.step)
+	}
+	if i >= len(s.perStep) {
+		i = len(s.perStep) - 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total += int64(n)
+	s.perStep[i] += int64(n)
+}
+
+// AddSeries records that n series were loaded from storage.
+func (s *SampleTracker) AddSeries(n int) {
+	if s == nil || n == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.series += int64(n)
+}
+
+// TotalSamples returns the number of samples selected by the query.
+func (s *SampleTracker) TotalSamples() int64 {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// TotalSeries returns the number of series loaded by the query.
+func (s *SampleTracker) TotalSeries() int64 {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.series
+}
+
+// QuerySamples returns the collected statistics in the Prometheus format. The peak is
+// taken from the sample limiter, which tracks the samples the query holds at the same time.
+func (s *SampleTracker) QuerySamples(enablePerStepStats bool, limiter *SampleLimiter) *stats.QuerySamples {
+	qs := stats.NewQuerySamples(enablePerStepStats)
+	qs.UpdatePeak(int(limiter.Peak()))
+	if s == nil {
+		return qs
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	step := s.step
+	if step == 0 {
+		step = 1
+	}
+	qs.InitStepTracking(s.start, s.start+int64(len(s.perStep)-1)*step, step)
+	for i, n := range s.perStep {
+		qs.IncrementSamplesAtStep(i, n)
+	}
+	return qs
+}
@@ -0,0 +1,43 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"sync"
+
+	"github.com/prometheus/prometheus/storage"
+)
+
+// Warnings collects errors which do not fail the query, and which are
+// returned as warnings of its result.
+// It is safe for concurrent use, and all methods can be called on a nil collector.
+type Warnings struct {
+	mu       sync.Mutex
+	warnings storage.Warnings
+}
+
+// NewWarnings creates an empty collector of warnings.
+func NewWarnings() *Warnings {
+	return &Warnings{}
+}
+
+// Add records err as a warning of the query.
+func (w *Warnings) Add(err error) {
+	if w == nil || err == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = append(w.warnings, err)
+}
+
+// Get returns the warnings which were recorded so far.
+func (w *Warnings) Get() storage.Warnings {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.warnings[:len(w.warnings):len(w.warnings)]
+}
@@ -5,93 +5,86 @@ package worker
 
 import (
 	"context"
-	"sync"
 
 	"github.com/thanos-community/promql-engine/execution/model"
 )
 
-type doneFunc func()
-
-type Group []*Worker
-
-func NewGroup(numWorkers int, task Task) Group {
-	group := make([]*Worker, numWorkers)
-	for i := 0; i < numWorkers; i++ {
-		group[i] = New(i, task)
-	}
-	return group
-}
-
-func (g Group) Start(ctx context.Context) {
-	var wg sync.WaitGroup
-	for _, w := range g {
-		wg.Add(1)
-		go w.start(wg.Done, ctx)
-	}
-	wg.Wait()
-}
-
 type input struct {
-	arg float64
-	in  model.StepVector
+	stepID int
+	arg    float64
+	in     model.StepVector
 }
 
-type Worker struct {
+// Group executes a task for each step of a batch. Steps are distributed over
+// a number of workers which is limited by the parallelism of the query, so that
+// a group does not start more goroutines than the query is allowed to use.
+type Group struct {
 	ctx context.Context
 
-	workerID int
-	input    chan *input
-	output   chan model.StepVector
-	doWork   Task
+	numWorkers int
+	input      chan *input
+	outputs    []chan model.StepVector
+	doWork     Task
 }
 
-type Task func(workerID int, arg float64, in model.StepVector) model.StepVector
+// Task processes the vector of the step with the given ID. Steps with
+// different IDs can be processed concurrently by different workers.
+type Task func(stepID int, arg float64, in model.StepVector) model.StepVector
 
-func New(workerID int, task Task) *Worker {
-	input := make(chan *input, 1)
-	output := make(chan model.StepVector, 1)
+// NewGroup creates a group which processes batches of numSteps steps with at most parallelism
+// workers. A non-positive parallelism starts one worker for each step.
+func NewGroup(numSteps int, parallelism int, task Task) *Group {
+	numWorkers := numSteps
+	if parallelism > 0 && parallelism < numSteps {
+		numWorkers = parallelism
+	}
+	outputs := make([]chan model.StepVector, numSteps)
+	for i := range outputs {
+		outputs[i] = make(chan model.StepVector, 1)
+	}
+	return &Group{
+		numWorkers: numWorkers,
+		input:      make(chan *input, numSteps),
+		outputs:    outputs,
+		doWork:     task,
+	}
+}
 
-	return &Worker{
-		workerID: workerID,
-		input:    input,
-		output:   output,
-		doWork:   task,
+// Start starts the workers of the group. They stop once ctx is done.
+func (g *Group) Start(ctx context.Context) {
+	g.ctx = ctx
+	for i := 0; i < g.numWorkers; i++ {
+		go g.start()
 	}
 }
 
-func (w *Worker) start(done doneFunc, ctx context.Context) {
-	w.ctx = ctx
-	done()
+func (g *Group) start() {
 	for {
 		select {
-		case <-w.ctx.Done():
-			close(w.output)
+		case <-g.ctx.Done():
 			return
-		case task, ok := <-w.input:
-			if !ok {
-				return
-			}
-			w.output <- w.doWork(w.workerID, task.arg, task.in)
+		case task := <-g.input:
+			g.outputs[task.stepID] <- g.doWork(task.stepID, task.arg, task.in)
 		}
 	}
 }
 
-func (w *Worker) Send(arg float64, in model.StepVector) error {
+// Send schedules the vector of the step with the given ID to be processed by one of the workers.
+func (g *Group) Send(stepID int, arg float64, in model.StepVector) error {
 	select {
-	case <-w.ctx.Done():
-		close(w.input)
-		return w.ctx.Err()
-	default:
-		w.input <- &input{arg: arg, in: in}
+	case <-g.ctx.Done():
+		return g.ctx.Err()
+	case g.input <- &input{stepID: stepID, arg: arg, in: in}:
 		return nil
 	}
 }
 
-func (w *Worker) GetOutput() (model.StepVector, error) {
+// GetOutput waits for the output of the step with the given ID.
+func (g *Group) GetOutput(stepID int) (model.StepVector, error) {
 	select {
-	case <-w.ctx.Done():
-		return model.StepVector{}, w.ctx.Err()
-	default:
-		return <-w.output, nil
+	case <-g.ctx.Done():
+		return model.StepVector{}, g.ctx.Err()
+	case out := <-g.outputs[stepID]:
+		return out, nil
 	}
 }